@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -17,18 +16,22 @@ import (
 	"gopkg.in/amz.v1/aws"
 	"gopkg.in/amz.v1/s3"
 
-	"github.com/couchbase/go-couchbase"
 	"github.com/jeffail/tunny"
 	"github.com/moonfrog/badger/common"
 	log "github.com/moonfrog/badger/logger"
-	"github.com/moonfrog/badger/zootils"
+	"github.com/moonfrog/cbutils/internal/config"
 )
 
 var fileMap, newMap map[string]bool
 
+// objectSizes holds the size of each s3 key seen in a listing so space can
+// be reserved before downloading it
+var objectSizes = make(map[string]int64)
+
 type CouchbaseConfig struct {
 	ServerURL string
 	Bucket    string
+	Targets   []CouchbaseTarget // optional, every document is written to each
 }
 
 // global
@@ -48,29 +51,44 @@ var tdiff = flag.Int("tdiff", 12, "time window")
 var basedir = flag.String("baseDir", "/tmp", "base directory for saving files")
 var scale = flag.Int("scale", 1, "scale factor")
 
+var loader = config.New()
+
 var excludeCols = []string{"date", "day", "hour", "minute", "month", "second", "year", "time"}
 
+// economyKey are the columns of an economy log row in its document key
+var economyKey = []string{"pid", "timestamp"}
+
 func main() {
 
+	var s3Config S3Config
+	loader.Add("config/couchbase", &cbConfig)
+	loader.AddOptional("config/s3Config", &s3Config)
+
 	flag.Parse()
 
+	shardN, shardM, err := parseShard(*shard)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+	if *downloaders < 1 {
+		log.Fatal("Need at least one downloader, got %v", *downloaders)
+	}
+
 	maxThreads = runtime.NumCPU() * *scale
 	runtime.GOMAXPROCS(maxThreads)
 
 	common.Init("cbload", 3000)
-	err := zootils.GetInstance().LoadConfig(&cbConfig, "config/couchbase", func(string) {})
+	err = loader.Load()
 
 	if err != nil {
 		log.Fatal("Couldn't load config. Err - %s", err)
 
 	}
 
-	if cbConfig.ServerURL == "" || cbConfig.Bucket == "" {
+	if (cbConfig.ServerURL == "" || cbConfig.Bucket == "") && len(cbConfig.Targets) == 0 {
 		log.Fatal("Config error %v", cbConfig)
 	}
 
-	var s3Config S3Config
-	zootils.GetInstance().LoadConfig(&s3Config, "config/s3Config", func(string) {})
 	if s3Config.AwsKey == "" || s3Config.AwsSecret == "" {
 		log.Fatal("Missing aws credentials. AwsKey - %s, awsSecret - %s.", s3Config.AwsKey, s3Config.AwsSecret)
 	}
@@ -78,6 +96,21 @@ func main() {
 	auth := aws.Auth{s3Config.AwsKey, s3Config.AwsSecret}
 	s3b := s3.New(auth, aws.USEast).Bucket(*s3Bucket)
 
+	if *manifest != "" {
+		if *unloadColumns == "" {
+			log.Fatal("-columns is required to load unload output")
+		}
+		if _, _, err := unloadSchema(); err != nil {
+			log.Fatal("%v", err)
+		}
+		parts, err := readManifest(s3b, *manifest)
+		if err != nil {
+			log.Fatal("Unable to read manifest %v. Err - %v", *manifest, err)
+		}
+		load(s3b, shardFiles(parts, shardN, shardM))
+		return
+	}
+
 	list, err := s3b.List("stats@economy@cash@", "", "", 1000)
 	data := []string{}
 	if err == nil {
@@ -94,24 +127,37 @@ func main() {
 		log.Warn("Connection error: %v", err)
 	}
 
-	filtered := processList(data)
+	load(s3b, shardFiles(processList(data), shardN, shardM))
+}
+
+// load downloads the files from s3 through the staging area and loads them
+// into couchbase
+func load(s3b *s3.Bucket, filtered []string) {
 	if len(filtered) == 0 {
-		log.Fatal("No files to process")
+		log.Fatal("No files to process for shard %v", *shard)
 	}
 
 	log.Info("Number of files to process %v", len(filtered))
 
+	var err error
+	staging, err = newStagingArea(*basedir)
+	if err != nil {
+		log.Fatal("Unable to create staging directory in %v. Err - %v", *basedir, err)
+	}
+	staging.cleanupOnSignal()
+	defer staging.cleanup()
+
 	loaderChan := make(chan string, 20)
 	doneChan := make(chan bool)
 	go processFile(loaderChan, doneChan)
 
-	fList := make([][]string, 2)
+	fList := make([][]string, *downloaders)
 
 	for i, file := range filtered {
-		fList[i%2] = append(fList[i%2], file)
+		fList[i%*downloaders] = append(fList[i%*downloaders], file)
 	}
 
-	for i := 0; i < 2; i++ {
+	for i := 0; i < *downloaders; i++ {
 		downloadWg.Add(1)
 		go downloadFiles(fList[i], s3b, loaderChan)
 	}
@@ -132,6 +178,7 @@ func populateList(data []string, list *s3.ListResp) []string {
 				newMap[elem.Key] = true
 			} else {
 				data = append(data, elem.Key)
+				objectSizes[elem.Key] = elem.Size
 			}
 		}
 	}
@@ -165,27 +212,61 @@ func downloadFiles(fileList []string, bucket *s3.Bucket, loaderChan chan string)
 	defer downloadWg.Done()
 
 	for _, file := range fileList {
+		size, err := objectSize(bucket, file)
+		if err != nil {
+			fatal("Unable to get size of %v %v", file, err)
+		}
+
+		// wait for room before the file is held in memory
+		localFile, err := staging.reserve(file, size)
+		if err != nil {
+			fatal("Unable to stage %v %v", file, err)
+		}
+
 	retry:
 		fileBytes, err := bucket.Get(file)
 		if err != nil {
 			log.Error("Get failed %v", err)
 			goto retry // retry endlessly
 		}
-
-		localFile := *basedir + "/" + file
+		if int64(len(fileBytes)) != size {
+			if err = staging.resize(localFile, int64(len(fileBytes))); err != nil {
+				fatal("Unable to stage %v %v", file, err)
+			}
+		}
 
 		err = ioutil.WriteFile(localFile, fileBytes, 0644)
 		if err != nil {
-			log.Fatal("Writing to file failed %v", err)
+			fatal("Writing to file failed %v", err)
 		}
+		staging.written(localFile)
 
 		loaderChan <- localFile
 	}
 }
 
+// objectSize returns the size of an s3 key from the listing, listing the
+// key itself if it wasn't seen before
+func objectSize(bucket *s3.Bucket, key string) (int64, error) {
+	if size, ok := objectSizes[key]; ok {
+		return size, nil
+	}
+
+	list, err := bucket.List(key, "", "", 1)
+	if err != nil {
+		return 0, err
+	}
+	for _, elem := range list.Contents {
+		if elem.Key == key {
+			return elem.Size, nil
+		}
+	}
+	return 0, fmt.Errorf("%v not found in bucket", key)
+}
+
 type work struct {
 	filePath string
-	cbBucket *couchbase.Bucket
+	targets  []*target
 }
 
 var numQueued int
@@ -196,19 +277,9 @@ func processFile(loaderChan chan string, doneChan chan bool) {
 	defer close(doneChan)
 
 	numFiles := 0
-	client, err := couchbase.Connect(cbConfig.ServerURL)
+	targets, err := connectTargets(cbConfig)
 	if err != nil {
-		log.Fatal("Unable to connect to couchbase server %v", err)
-	}
-
-	pool, err := client.GetPool("default")
-	if err != nil {
-		log.Fatal("Default pool not found %v", err)
-	}
-
-	bucket, err := pool.GetBucket(*cbBucket)
-	if err != nil {
-		log.Fatal("Bucket %d not found", *cbBucket)
+		fatal("Unable to set up couchbase targets %v", err)
 	}
 
 	threadPool, _ := tunny.CreatePool(maxThreads, unzipAndLoad).Open()
@@ -222,7 +293,7 @@ func processFile(loaderChan chan string, doneChan chan bool) {
 				//queue work to the threadpool
 				wg.Add(1)
 				go func() {
-					work := &work{filePath: fp, cbBucket: bucket}
+					work := &work{filePath: fp, targets: targets}
 					err, _ := threadPool.SendWork(work)
 					if err != nil {
 						log.Error("Unzip and Load Returned error %v", err)
@@ -239,6 +310,9 @@ func processFile(loaderChan chan string, doneChan chan bool) {
 
 	log.Info("Finished queueing all jobs %v", numFiles)
 	wg.Wait()
+	if err = closeTargets(targets); err != nil {
+		fatal("Loading incomplete: %v", err)
+	}
 
 }
 
@@ -247,15 +321,19 @@ func unzipAndLoad(w interface{}) interface{} {
 	defer wg.Done()
 
 	filePath := w.(*work).filePath
-	cbBucket := w.(*work).cbBucket
+	targets := w.(*work).targets
+
+	// the staged file is removed on every return path
+	defer staging.release(filePath)
 
 	file, err := os.Open(filePath)
 	if err != nil {
 		log.Error("Unable to open file for reading %v", err)
 		return err
 	}
-	reader, err := gzip.NewReader(file)
+	reader, err := openStaged(file)
 	if err != nil {
+		file.Close()
 		return err
 	}
 
@@ -266,96 +344,98 @@ func unzipAndLoad(w interface{}) interface{} {
 	}
 	file.Close()
 
-	docs, err := jsonifyFile(lines)
+	var docs map[string]interface{}
+	if *manifest != "" {
+		docs, err = jsonifyUnload(filePath, lines)
+	} else {
+		docs, err = jsonifyFile(lines)
+	}
 	if err != nil {
 		log.Error("Failed to jsonify file %v", err)
 	}
 
-	errs := loadKeys(cbBucket, docs)
-	if errs != nil {
-		log.Error("Failed to load some keys %v", len(errs))
-
+	// each target retries its own failures and never waits for another
+	if len(docs) > 0 {
+		for _, t := range targets {
+			t.enqueue(docs)
+		}
 	}
 	numProcessed++
 	log.Info("===== Processed %v", numProcessed)
-	os.Remove(filePath)
 	return nil
 }
 
 func jsonifyFile(rows []string) (map[string]interface{}, error) {
 
-	var schema []string
-
-	docs := make(map[string]interface{})
-	colOffset := make([]int, 0)
+	if len(rows) == 0 {
+		return make(map[string]interface{}), nil
+	}
 
-	for i, row := range rows {
+	// row 0 is the schema line
+	schema := strings.Split(rows[0], ",")
+	if len(schema) < 2 {
+		return nil, fmt.Errorf("Invalid file format. Failed to parse schema line. Row %s", rows[0])
+	}
 
-		// row 0 is the schema line
-		value := make(map[string]interface{})
-		if i == 0 {
-			schema = strings.Split(row, ",")
-			if len(schema) < 2 {
-				return nil, fmt.Errorf("Invalid file format. Failed to parse schema line. Row %s", row)
-			}
+	data := make([][]string, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		data = append(data, strings.Split(row, ","))
+	}
 
-			for j, col := range schema {
-				exclude := false
-			innerLoop:
-				for _, ec := range excludeCols {
-					if col == ec {
-						exclude = true
-						break innerLoop
-					}
-				}
-				if exclude == false {
-					colOffset = append(colOffset, j)
-				}
-			}
+	return jsonifyRows(schema, data, excludeCols, economyKey, "", 1), nil
+}
 
-		} else {
-			// generate a json document from each row
-			var key string
-			colData := strings.Split(row, ",")
-			if len(colData) != len(schema) {
-				log.Warn("Mismatched schema Rows %v Schema %v", colData, schema)
-			}
+// jsonifyRows generates a json document from each row, leaving out the
+// exclude columns. The document key is made of the keys columns, which must
+// be set, then part and the line number of the row; first is the line number
+// of rows[0] in its file. part tells apart files whose line numbers would
+// collide.
+func jsonifyRows(schema []string, rows [][]string, exclude, keys []string, part string, first int) map[string]interface{} {
 
-			// only jsonify the offsets that not part of the exclude list
-			for _, offset := range colOffset {
-				value[schema[offset]] = colData[offset]
-			}
+	docs := make(map[string]interface{})
+	colOffset := make([]int, 0)
 
-			// generate a unique for the data
-			if value["timestamp"] == "" || value["pid"] == "" {
-				log.Error("Values not found for timestamp or pid")
-				continue
+	for j, col := range schema {
+		excluded := false
+	innerLoop:
+		for _, ec := range exclude {
+			if col == ec {
+				excluded = true
+				break innerLoop
 			}
-			key = fmt.Sprintf("key-%v-%v-%d", value["pid"], value["timestamp"], i)
-			marshalled, _ := json.MarshalIndent(value, "", "    ")
-			docs[key] = marshalled
+		}
+		if excluded == false {
+			colOffset = append(colOffset, j)
 		}
 	}
-	return docs, nil
-}
 
-func loadKeys(bucket *couchbase.Bucket, docs map[string]interface{}) []error {
+rowLoop:
+	for i, colData := range rows {
 
-	errors := make([]error, 0)
+		value := make(map[string]interface{})
+		if len(colData) != len(schema) {
+			log.Warn("Mismatched schema Rows %v Schema %v", colData, schema)
+		}
 
-	for key, value := range docs {
-		added, err := bucket.AddRaw(key, 0, value.([]byte))
-		if err != nil {
-			log.Error("Failed to add key %v. Error %v", key, err)
-			errors = append(errors, fmt.Errorf("Error adding key %v, Error %v", key, err))
-		} else if added == false {
-			errors = append(errors, fmt.Errorf("Key not added %v", key))
+		// only jsonify the offsets that not part of the exclude list
+		for _, offset := range colOffset {
+			if offset < len(colData) {
+				value[schema[offset]] = colData[offset]
+			}
 		}
-	}
 
-	if len(errors) > 0 {
-		return errors
+		// generate a unique for the data
+		key := "key-"
+		for _, col := range keys {
+			if value[col] == nil || value[col] == "" {
+				log.Error("Values not found for key column %v", col)
+				continue rowLoop
+			}
+			key += fmt.Sprintf("%v-", value[col])
+		}
+		key += fmt.Sprintf("%s%d", part, first+i)
+		marshalled, _ := json.MarshalIndent(value, "", "    ")
+		docs[key] = marshalled
 	}
-
-	return nil
+	return docs
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+var shard = flag.String("shard", "0/1", "N/M, load only the files hashed to shard N of M (0 <= N < M)")
+var downloaders = flag.Int("downloaders", 2, "number of concurrent s3 downloads")
+
+// parseShard parses a "N/M" shard specification
+func parseShard(spec string) (int, int, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected N/M", spec)
+	}
+	n, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected N/M: %v", spec, err)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected N/M: %v", spec, err)
+	}
+	if m < 1 || n < 0 || n >= m {
+		return 0, 0, fmt.Errorf("invalid shard %q, need 0 <= N < M", spec)
+	}
+	return n, m, nil
+}
+
+// shardFiles keeps the s3 keys that hash to shard n of m. The hash only
+// depends on the key so every host agrees on the assignment.
+func shardFiles(files []string, n, m int) []string {
+	if m == 1 {
+		return files
+	}
+
+	owned := make([]string, 0, len(files)/m+1)
+	for _, file := range files {
+		h := fnv.New32a()
+		h.Write([]byte(file))
+		if int(h.Sum32()%uint32(m)) == n {
+			owned = append(owned, file)
+		}
+	}
+	return owned
+}
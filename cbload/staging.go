@@ -0,0 +1,242 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/moonfrog/badger/logger"
+)
+
+const stagingPrefix = "cbload."
+
+var maxStagedBytes = flag.Int64("maxStagedBytes", 2<<30, "max bytes of downloaded files waiting to be loaded, 0 for no limit")
+var maxStagedFiles = flag.Int("maxStagedFiles", 40, "max number of downloaded files waiting to be loaded, 0 for no limit")
+var minFreeBytes = flag.Int64("minFreeBytes", 512<<20, "free space to leave on the baseDir filesystem")
+
+// stagingArea owns the per-run directory under baseDir where files are
+// downloaded before being loaded. Downloads block in reserve until the
+// loader has released enough files to stay within budget.
+type stagingArea struct {
+	dir string
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	bytes int64
+	files map[string]int64
+
+	// reserved for downloads that haven't been written yet, which Statfs
+	// can't see
+	unwritten map[string]int64
+	pending   int64
+}
+
+var staging *stagingArea
+
+// newStagingArea removes staging directories left behind by dead cbload
+// processes and creates a fresh one for this run.
+func newStagingArea(baseDir string) (*stagingArea, error) {
+	removeOrphans(baseDir)
+
+	dir := filepath.Join(baseDir, fmt.Sprintf("%s%d", stagingPrefix, os.Getpid()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	sa := &stagingArea{dir: dir, files: make(map[string]int64), unwritten: make(map[string]int64)}
+	sa.cond = sync.NewCond(&sa.mu)
+	return sa, nil
+}
+
+// removeOrphans deletes cbload.<pid> directories whose process is gone.
+// A directory with our own pid is stale too, left by an earlier run that
+// had the same pid, which is common in containers.
+func removeOrphans(baseDir string) {
+	entries, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		log.Warn("Unable to scan %v for orphaned files %v", baseDir, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), stagingPrefix) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimPrefix(entry.Name(), stagingPrefix))
+		if err != nil || (pid != os.Getpid() && processAlive(pid)) {
+			continue
+		}
+		path := filepath.Join(baseDir, entry.Name())
+		log.Info("Removing orphaned staging directory %v", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Warn("Failed to remove %v %v", path, err)
+		}
+	}
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// path returns the local file name used for an s3 key
+func (sa *stagingArea) path(key string) string {
+	return filepath.Join(sa.dir, stagedName(key))
+}
+
+// stagedName is the base name of the staged file of an s3 key
+func stagedName(key string) string {
+	return strings.Replace(key, "/", "_", -1)
+}
+
+// reserve blocks until size more bytes can be staged. A file larger than the
+// whole budget is let through once nothing else is staged so it can't
+// deadlock. An error is returned only if the disk is full with nothing staged.
+func (sa *stagingArea) reserve(key string, size int64) (string, error) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+
+	if err := sa.waitFor(size); err != nil {
+		return "", err
+	}
+
+	path := sa.path(key)
+	sa.files[path] = size
+	sa.bytes += size
+	sa.unwritten[path] = size
+	sa.pending += size
+	return path, nil
+}
+
+// waitFor blocks until size more bytes fit, sa.mu must be held
+func (sa *stagingArea) waitFor(size int64) error {
+	for {
+		if len(sa.files) == 0 {
+			return sa.checkFree(size)
+		}
+		if sa.withinBudget(size) && sa.checkFree(size) == nil {
+			return nil
+		}
+		sa.cond.Wait()
+	}
+}
+
+func (sa *stagingArea) withinBudget(size int64) bool {
+	if *maxStagedFiles > 0 && len(sa.files) >= *maxStagedFiles {
+		return false
+	}
+	if *maxStagedBytes > 0 && sa.bytes+size > *maxStagedBytes {
+		return false
+	}
+	return true
+}
+
+func (sa *stagingArea) checkFree(size int64) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(sa.dir, &st); err != nil {
+		return err
+	}
+	free := int64(st.Bavail)*int64(st.Bsize) - sa.pending
+	if free-size < *minFreeBytes {
+		return fmt.Errorf("not enough space in %v: %d bytes free, need %d", sa.dir, free, size+*minFreeBytes)
+	}
+	return nil
+}
+
+// resize corrects the size reserved for a staged file once its real size
+// is known. A file that turned out larger waits for room like a new
+// reservation.
+func (sa *stagingArea) resize(path string, size int64) error {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	defer sa.cond.Broadcast()
+
+	old, ok := sa.files[path]
+	if !ok {
+		return nil
+	}
+
+	if size > old {
+		// give up the old reservation while waiting so the file is only
+		// counted once
+		sa.forget(path)
+		if err := sa.waitFor(size); err != nil {
+			return err
+		}
+		sa.files[path] = size
+		sa.bytes += size
+		sa.unwritten[path] = size
+		sa.pending += size
+		return nil
+	}
+
+	sa.bytes += size - old
+	sa.files[path] = size
+	if _, ok := sa.unwritten[path]; ok {
+		sa.pending += size - sa.unwritten[path]
+		sa.unwritten[path] = size
+	}
+	return nil
+}
+
+// written records that a staged file is on disk, where Statfs sees it
+func (sa *stagingArea) written(path string) {
+	sa.mu.Lock()
+	sa.pending -= sa.unwritten[path]
+	delete(sa.unwritten, path)
+	sa.mu.Unlock()
+}
+
+// forget drops the reservation of a file, sa.mu must be held
+func (sa *stagingArea) forget(path string) {
+	sa.bytes -= sa.files[path]
+	delete(sa.files, path)
+	sa.pending -= sa.unwritten[path]
+	delete(sa.unwritten, path)
+}
+
+// release removes a staged file and wakes up blocked downloads
+func (sa *stagingArea) release(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Warn("Failed to remove staged file %v %v", path, err)
+	}
+
+	sa.mu.Lock()
+	sa.forget(path)
+	sa.mu.Unlock()
+	sa.cond.Broadcast()
+}
+
+// cleanup removes the staging directory and everything left in it
+func (sa *stagingArea) cleanup() {
+	if err := os.RemoveAll(sa.dir); err != nil {
+		log.Warn("Failed to clean up %v %v", sa.dir, err)
+	}
+}
+
+// cleanupOnSignal removes the staging directory when cbload is interrupted
+func (sa *stagingArea) cleanupOnSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		sig := <-sigChan
+		log.Warn("Received %v, cleaning up %v", sig, sa.dir)
+		sa.cleanup()
+		os.Exit(1)
+	}()
+}
+
+// fatal cleans up staged files before exiting
+func fatal(format string, args ...interface{}) {
+	if staging != nil {
+		staging.cleanup()
+	}
+	log.Fatal(format, args...)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+	log "github.com/moonfrog/badger/logger"
+)
+
+var targetQueue = flag.Int("targetQueue", 100, "files buffered per couchbase target, a target whose queue is full keeps further files in memory and writes them after its queue drains")
+var maxRetries = flag.Int("maxRetries", 5, "times a failed key is retried on a target")
+var retryDelay = flag.Duration("retryDelay", 2*time.Second, "delay before the first retry, doubled on each attempt")
+
+// CouchbaseTarget is one cluster/bucket that every document is written to
+type CouchbaseTarget struct {
+	Name      string
+	ServerURL string
+	Bucket    string
+}
+
+// targets returns the configured targets. Without a Targets list the
+// ServerURL from the config and the -cbBucket flag are used as the only one.
+func (c CouchbaseConfig) targets() []CouchbaseTarget {
+	if len(c.Targets) == 0 {
+		return []CouchbaseTarget{{Name: "default", ServerURL: c.ServerURL, Bucket: *cbBucket}}
+	}
+
+	targets := make([]CouchbaseTarget, 0, len(c.Targets))
+	for i, t := range c.Targets {
+		if t.Bucket == "" {
+			t.Bucket = *cbBucket
+		}
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("target%d", i)
+		}
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// target writes documents to a single cluster from its own queue so that a
+// slow or failing cluster only delays itself.
+type target struct {
+	CouchbaseTarget
+
+	bucket *couchbase.Bucket
+	queue  chan map[string]interface{}
+
+	// files that arrived while the queue was full, written in a retry pass
+	// once the queue is closed and drained
+	mu       sync.Mutex
+	deferred []map[string]interface{}
+
+	added    int64
+	skipped  int64
+	failed   int64
+	overflow int64
+}
+
+var targetWg sync.WaitGroup
+
+// unreachable holds the targets that couldn't be connected to, the others
+// are still loaded
+var unreachable []string
+
+func connectTarget(t CouchbaseTarget) (*target, error) {
+	client, err := couchbase.Connect(t.ServerURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to couchbase server %v: %v", t.ServerURL, err)
+	}
+
+	pool, err := client.GetPool("default")
+	if err != nil {
+		return nil, fmt.Errorf("default pool not found on %v: %v", t.ServerURL, err)
+	}
+
+	bucket, err := pool.GetBucket(t.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("bucket %v not found on %v: %v", t.Bucket, t.ServerURL, err)
+	}
+
+	return &target{
+		CouchbaseTarget: t,
+		bucket:          bucket,
+		queue:           make(chan map[string]interface{}, *targetQueue),
+	}, nil
+}
+
+// connectTargets connects to every configured target and starts its writer.
+// A target that can't be reached is logged and left out so the others are
+// still loaded; it is an error only if none can be reached.
+func connectTargets(config CouchbaseConfig) ([]*target, error) {
+	targets := make([]*target, 0)
+	for _, ct := range config.targets() {
+		t, err := connectTarget(ct)
+		if err != nil {
+			log.Error("Target %v: %v", ct.Name, err)
+			unreachable = append(unreachable, ct.Name)
+			continue
+		}
+		targetWg.Add(1)
+		go t.run()
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no couchbase target could be reached")
+	}
+	return targets, nil
+}
+
+// enqueue hands docs to the target without waiting. If the target has
+// fallen a whole queue behind the docs are kept for its retry pass, so it
+// can't hold up loading into the other targets.
+func (t *target) enqueue(docs map[string]interface{}) {
+	select {
+	case t.queue <- docs:
+	default:
+		log.Warn("Target %v: queue full, deferring %v keys", t.Name, len(docs))
+		atomic.AddInt64(&t.overflow, int64(len(docs)))
+		t.mu.Lock()
+		t.deferred = append(t.deferred, docs)
+		t.mu.Unlock()
+	}
+}
+
+func (t *target) run() {
+	defer targetWg.Done()
+
+	for docs := range t.queue {
+		t.write(docs)
+	}
+
+	// nothing is enqueued once the queue is closed
+	t.mu.Lock()
+	deferred := t.deferred
+	t.deferred = nil
+	t.mu.Unlock()
+
+	if len(deferred) > 0 {
+		log.Info("Target %v: writing %v deferred files", t.Name, len(deferred))
+	}
+	for _, docs := range deferred {
+		t.write(docs)
+	}
+}
+
+// write adds docs to the target, retrying the keys that fail
+func (t *target) write(docs map[string]interface{}) {
+	pending := docs
+	delay := *retryDelay
+	for attempt := 0; len(pending) > 0; attempt++ {
+		if attempt > 0 {
+			if attempt > *maxRetries {
+				log.Error("Target %v: giving up on %v keys", t.Name, len(pending))
+				atomic.AddInt64(&t.failed, int64(len(pending)))
+				return
+			}
+			log.Warn("Target %v: retrying %v keys, attempt %v", t.Name, len(pending), attempt)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		pending = t.loadKeys(pending)
+	}
+}
+
+// loadKeys adds docs to the target bucket and returns the ones that failed
+func (t *target) loadKeys(docs map[string]interface{}) map[string]interface{} {
+
+	failed := make(map[string]interface{})
+
+	for key, value := range docs {
+		added, err := t.bucket.AddRaw(key, 0, value.([]byte))
+		if err != nil {
+			log.Error("Target %v: failed to add key %v. Error %v", t.Name, key, err)
+			failed[key] = value
+		} else if added == false {
+			atomic.AddInt64(&t.skipped, 1)
+		} else {
+			atomic.AddInt64(&t.added, 1)
+		}
+	}
+
+	return failed
+}
+
+// reportTargets logs what was written to each target and returns the
+// number of keys that couldn't be written
+func reportTargets(targets []*target) int64 {
+	var failed int64
+	for _, t := range targets {
+		log.Info("Target %v (%v/%v): added %v, already present %v, failed %v, deferred %v",
+			t.Name, t.ServerURL, t.Bucket,
+			atomic.LoadInt64(&t.added), atomic.LoadInt64(&t.skipped), atomic.LoadInt64(&t.failed),
+			atomic.LoadInt64(&t.overflow))
+		failed += atomic.LoadInt64(&t.failed)
+	}
+	return failed
+}
+
+// closeTargets waits for every target to drain its queue and deferred
+// files. It returns an error if any key wasn't written or any target was
+// unreachable.
+func closeTargets(targets []*target) error {
+	for _, t := range targets {
+		close(t.queue)
+	}
+	targetWg.Wait()
+
+	failed := reportTargets(targets)
+	if len(unreachable) > 0 {
+		return fmt.Errorf("targets %v were unreachable, %v keys failed", strings.Join(unreachable, ","), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v keys failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+var manifest = flag.String("manifest", "", "s3 key of a redshift UNLOAD manifest to load instead of the economy logs")
+var unloadColumns = flag.String("columns", "", "comma separated column names of the UNLOAD output")
+var delimiter = flag.String("delimiter", "|", "field delimiter of the UNLOAD output")
+var escaped = flag.Bool("escape", false, "UNLOAD output was written with ESCAPE")
+var keyColumns = flag.String("keyColumns", "", "comma separated UNLOAD columns that are part of each document key, before the part and row number")
+
+// partIndex is the position of each UNLOAD part in the manifest, by staged
+// file name. It keeps document keys of rows from different parts apart.
+var partIndex = make(map[string]int)
+
+// unloadManifest is the manifest file written by UNLOAD ... MANIFEST. The
+// part sizes are only there with MANIFEST VERBOSE.
+type unloadManifest struct {
+	Entries []struct {
+		URL  string `json:"url"`
+		Meta struct {
+			ContentLength int64 `json:"content_length"`
+		} `json:"meta"`
+	} `json:"entries"`
+}
+
+// readManifest returns the s3 keys of the parts listed in an UNLOAD
+// manifest. The parts have to be in the same bucket as the manifest.
+func readManifest(bucket *s3.Bucket, key string) ([]string, error) {
+	data, err := bucket.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var m unloadManifest
+	if err = json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+
+	prefix := "s3://" + *s3Bucket + "/"
+	parts := make([]string, 0, len(m.Entries))
+	for _, entry := range m.Entries {
+		if !strings.HasPrefix(entry.URL, prefix) {
+			return nil, fmt.Errorf("part %v is not in bucket %v", entry.URL, *s3Bucket)
+		}
+		part := strings.TrimPrefix(entry.URL, prefix)
+		if entry.Meta.ContentLength > 0 {
+			objectSizes[part] = entry.Meta.ContentLength
+		}
+		partIndex[stagedName(part)] = len(parts)
+		parts = append(parts, part)
+	}
+
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("manifest lists no parts")
+	}
+	return parts, nil
+}
+
+// openStaged returns a reader over a staged file, decompressing it if it
+// is gzipped. UNLOAD parts are only gzipped when unloaded with GZIP.
+func openStaged(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// unloadSchema checks -columns and -keyColumns and returns them. Every
+// column of an UNLOAD is kept, the economy log exclude list doesn't apply.
+func unloadSchema() ([]string, []string, error) {
+	schema := strings.Split(*unloadColumns, ",")
+	if len(schema) < 2 {
+		return nil, nil, fmt.Errorf("Invalid column list %v", *unloadColumns)
+	}
+
+	var keys []string
+	if *keyColumns != "" {
+		keys = strings.Split(*keyColumns, ",")
+	}
+	for _, key := range keys {
+		found := false
+		for _, col := range schema {
+			if col == key {
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("key column %v is not one of -columns", key)
+		}
+	}
+	return schema, keys, nil
+}
+
+// jsonifyUnload builds documents from the header-less rows of an UNLOAD
+// part using the column names given on the command line
+func jsonifyUnload(filePath string, rows []string) (map[string]interface{}, error) {
+
+	part, ok := partIndex[filepath.Base(filePath)]
+	if !ok {
+		return nil, fmt.Errorf("%v is not a part of the manifest", filePath)
+	}
+
+	schema, keys, err := unloadSchema()
+	if err != nil {
+		return nil, err
+	}
+
+	if *escaped {
+		rows = joinEscapedLines(rows)
+	}
+
+	data := make([][]string, 0, len(rows))
+	for _, row := range rows {
+		data = append(data, splitUnloadRow(row, *delimiter, *escaped))
+	}
+
+	return jsonifyRows(schema, data, nil, keys, fmt.Sprintf("p%d-", part), 0), nil
+}
+
+// joinEscapedLines puts back together rows that contain a line break. With
+// ESCAPE a line break inside a field is written as a backslash followed by
+// the newline, which the line scanner has split on. An even number of
+// trailing backslashes are escaped backslashes, not an escaped newline.
+func joinEscapedLines(lines []string) []string {
+	rows := make([]string, 0, len(lines))
+	var row string
+	continued := false
+	for _, line := range lines {
+		if continued {
+			row += "\n" + line
+		} else {
+			row = line
+		}
+
+		trailing := len(row) - len(strings.TrimRight(row, "\\"))
+		if continued = trailing%2 == 1; continued {
+			row = row[:len(row)-1]
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if continued {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// splitUnloadRow splits a row on delim. With escape set a backslash makes
+// the next character literal, so escaped delimiters stay inside the field.
+func splitUnloadRow(row, delim string, escape bool) []string {
+	if !escape {
+		return strings.Split(row, delim)
+	}
+
+	fields := make([]string, 0)
+	var field []byte
+	for i := 0; i < len(row); i++ {
+		switch {
+		case row[i] == '\\' && i+1 < len(row):
+			i++
+			field = append(field, row[i])
+		case strings.HasPrefix(row[i:], delim):
+			fields = append(fields, string(field))
+			field = field[:0]
+			i += len(delim) - 1
+		default:
+			field = append(field, row[i])
+		}
+	}
+	return append(fields, string(field))
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+	"gopkg.in/yaml.v2"
+)
+
+var rulesFile = flag.String("rules", "", "YAML or JSON file of alerting rules evaluated after each query run")
+var alertWebhook = flag.String("alertWebhook", "", "URL alerts are POSTed to as JSON, alerts are logged if empty")
+var alertState = flag.String("alertState", "batch30.alerts", "file keeping the rule history between runs, so window rules work without -schedule")
+
+// alertRule is one entry of the rules file. The condition compares a column
+// of every row matching the filter against a constant or an aggregate of the
+// same row's values in earlier windows, e.g.
+//
+//	val < 0.5 * avg(last 12 windows)
+//	kingdom=failure val > 100
+//
+// Leading column=value terms are added to the filter.
+type alertRule struct {
+	Name      string            `yaml:"name" json:"name"`
+	Query     string            `yaml:"query" json:"query"`
+	Filter    map[string]string `yaml:"filter" json:"filter"`
+	Condition string            `yaml:"condition" json:"condition"`
+
+	cond *condition
+}
+
+type rulesFileFormat struct {
+	Rules []*alertRule `yaml:"rules" json:"rules"`
+}
+
+// condition is a parsed rule condition: column op factor * agg(last n)
+// or column op factor when agg is empty
+type condition struct {
+	column string
+	op     string
+	factor float64
+	agg    string
+	n      int
+}
+
+func loadRules(path string, defs []*queryDef) ([]*alertRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rf rulesFileFormat
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		err = json.Unmarshal(data, &rf)
+	} else {
+		err = yaml.Unmarshal(data, &rf)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", path, err)
+	}
+
+	known := make(map[string]bool)
+	for _, def := range defs {
+		known[def.Name] = true
+	}
+
+	for i, rule := range rf.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if !known[rule.Query] {
+			return nil, fmt.Errorf("rule %v: unknown query %v", rule.Name, rule.Query)
+		}
+		if rule.Filter == nil {
+			rule.Filter = make(map[string]string)
+		}
+		rule.cond, err = parseCondition(rule.Condition, rule.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("rule %v: %v", rule.Name, err)
+		}
+	}
+	return rf.Rules, nil
+}
+
+// parseCondition parses [col=value ...] column op rhs where rhs is a number,
+// agg(last n [windows]) or a number times an aggregate. Filter terms are
+// added to filter and must be equality tests.
+func parseCondition(text string, filter map[string]string) (*condition, error) {
+	fields := strings.Fields(strings.NewReplacer("(", " ( ", ")", " ) ", "*", " * ").Replace(text))
+
+	// leading dimension filters
+	for len(fields) > 0 && strings.Contains(fields[0], "=") && !isOp(fields[0]) {
+		kv := strings.SplitN(fields[0], "=", 2)
+		if kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid filter %q, expected column=value", fields[0])
+		}
+		// only equality filters are supported, status!=ok would otherwise
+		// filter on a column named status!
+		if strings.ContainsAny(kv[0][len(kv[0])-1:], "!<>") || strings.HasPrefix(kv[1], "=") {
+			return nil, fmt.Errorf("invalid filter %q, only column=value filters are supported", fields[0])
+		}
+		filter[kv[0]] = kv[1]
+		fields = fields[1:]
+	}
+
+	if len(fields) < 3 || !isOp(fields[1]) {
+		return nil, fmt.Errorf("invalid condition %q, expected: column op value", text)
+	}
+	c := &condition{column: fields[0], op: fields[1], factor: 1}
+	rhs := fields[2:]
+
+	// optional leading or trailing factor
+	if len(rhs) >= 3 && rhs[1] == "*" {
+		f, err := strconv.ParseFloat(rhs[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid factor %v", rhs[0])
+		}
+		c.factor, rhs = f, rhs[2:]
+	} else if n := len(rhs); n >= 3 && rhs[n-2] == "*" {
+		f, err := strconv.ParseFloat(rhs[n-1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid factor %v", rhs[n-1])
+		}
+		c.factor, rhs = f, rhs[:n-2]
+	}
+
+	if len(rhs) == 1 {
+		f, err := strconv.ParseFloat(rhs[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %v", rhs[0])
+		}
+		c.factor *= f
+		return c, nil
+	}
+
+	// agg ( last n [windows] )
+	if len(rhs) < 5 || rhs[1] != "(" || rhs[2] != "last" || rhs[len(rhs)-1] != ")" {
+		return nil, fmt.Errorf("invalid condition %q, expected e.g. avg(last 12 windows)", text)
+	}
+	switch rhs[0] {
+	case "avg", "min", "max", "sum":
+		c.agg = rhs[0]
+	default:
+		return nil, fmt.Errorf("unknown aggregate %v", rhs[0])
+	}
+	n, err := strconv.Atoi(rhs[3])
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid window count %v", rhs[3])
+	}
+	c.n = n
+	return c, nil
+}
+
+func isOp(s string) bool {
+	switch s {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	}
+	return false
+}
+
+// threshold returns the value compared against, ok is false while there is
+// no history to aggregate
+func (c *condition) threshold(history []float64) (float64, bool) {
+	if c.agg == "" {
+		return c.factor, true
+	}
+	if len(history) == 0 {
+		return 0, false
+	}
+
+	agg := history[0]
+	sum := 0.0
+	for _, v := range history {
+		sum += v
+		switch {
+		case c.agg == "min" && v < agg:
+			agg = v
+		case c.agg == "max" && v > agg:
+			agg = v
+		}
+	}
+	switch c.agg {
+	case "avg":
+		agg = sum / float64(len(history))
+	case "sum":
+		agg = sum
+	}
+	return c.factor * agg, true
+}
+
+func (c *condition) holds(val, threshold float64) bool {
+	switch c.op {
+	case "<":
+		return val < threshold
+	case "<=":
+		return val <= threshold
+	case ">":
+		return val > threshold
+	case ">=":
+		return val >= threshold
+	case "==":
+		return val == threshold
+	default:
+		return val != threshold
+	}
+}
+
+// alert is what gets delivered when a rule starts or stops firing
+type alert struct {
+	Rule        string            `json:"rule"`
+	Query       string            `json:"query"`
+	State       string            `json:"state"` // firing or resolved
+	Group       map[string]string `json:"group"`
+	Condition   string            `json:"condition"`
+	Value       float64           `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	WindowStart int64             `json:"windowStart"`
+	WindowEnd   int64             `json:"windowEnd"`
+}
+
+// alertSink evaluates the rules against each result. An alert is sent when a
+// group starts matching a rule and again when it stops, not on every window.
+// A group seen before that is missing from a result is evaluated with a
+// value of 0, so a count that stops entirely is caught too.
+type alertSink struct {
+	mu     sync.Mutex
+	rules  []*alertRule
+	state  alertHistory
+	client *http.Client
+}
+
+// alertHistory is what the alert sink remembers between windows, saved to
+// -alertState after every result. Keys are rule|group.
+type alertHistory struct {
+	History map[string][]float64         `json:"history"` // earlier values, oldest first
+	Firing  map[string]bool              `json:"firing"`
+	Groups  map[string]map[string]string `json:"groups"` // groups seen, by key
+}
+
+func newAlertSink(rules []*alertRule) (*alertSink, error) {
+	as := &alertSink{
+		rules: rules,
+		state: alertHistory{
+			History: make(map[string][]float64),
+			Firing:  make(map[string]bool),
+			Groups:  make(map[string]map[string]string),
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	if *alertState == "" {
+		return as, nil
+	}
+
+	data, err := ioutil.ReadFile(*alertState)
+	if os.IsNotExist(err) {
+		return as, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &as.state); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", *alertState, err)
+	}
+	return as, nil
+}
+
+// save replaces the state file atomically, as.mu must be held
+func (as *alertSink) save() error {
+	if *alertState == "" {
+		return nil
+	}
+	data, err := json.Marshal(&as.state)
+	if err != nil {
+		return err
+	}
+	tmp := *alertState + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *alertState)
+}
+
+func (as *alertSink) write(result *queryResult) error {
+	if result.err != nil {
+		return nil
+	}
+
+	as.mu.Lock()
+	alerts := make([]*alert, 0)
+	evaluated := false
+	for _, rule := range as.rules {
+		if rule.Query != result.name {
+			continue
+		}
+		evaluated = true
+
+		seen := make(map[string]bool)
+		for _, row := range result.rows {
+			if !matches(rule.Filter, row) {
+				continue
+			}
+			val, ok := n1ql.Float(row[rule.cond.column])
+			if !ok {
+				continue
+			}
+			group := groupOf(row, append(result.valueColumns(), rule.cond.column))
+			key := rule.Name + "|" + groupKey(group)
+			seen[key] = true
+			if a := as.evaluate(rule, result, key, group, val); a != nil {
+				alerts = append(alerts, a)
+			}
+		}
+
+		for key, group := range as.state.Groups {
+			if seen[key] || !strings.HasPrefix(key, rule.Name+"|") || !sameTags(group, result.tags) {
+				continue
+			}
+			if a := as.evaluate(rule, result, key, group, 0); a != nil {
+				alerts = append(alerts, a)
+			}
+			if !as.state.Firing[key] {
+				// gone and not firing, forget it
+				delete(as.state.Groups, key)
+				delete(as.state.History, key)
+				delete(as.state.Firing, key)
+			}
+		}
+	}
+
+	var err error
+	if evaluated {
+		err = as.save()
+	}
+	as.mu.Unlock()
+
+	for _, a := range alerts {
+		if err := as.deliver(a); err != nil {
+			log.Printf("Unable to deliver alert %v, Error %v", a.Rule, err)
+		}
+	}
+	return err
+}
+
+func matches(filter map[string]string, row map[string]interface{}) bool {
+	for col, want := range filter {
+		if n1ql.String(row[col]) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// sameTags reports whether a group belongs to the game or other dimension
+// values of a result, results of other games don't say a group is missing
+func sameTags(group map[string]string, tags map[string]interface{}) bool {
+	for k, v := range tags {
+		if group[k] != n1ql.String(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// evaluate checks the value of one group against a rule and records it. It
+// returns an alert if the group's firing state changed.
+func (as *alertSink) evaluate(rule *alertRule, result *queryResult, key string, group map[string]string, val float64) *alert {
+	as.state.Groups[key] = group
+
+	history := as.state.History[key]
+	threshold, ok := rule.cond.threshold(history)
+
+	if rule.cond.agg != "" {
+		history = append(history, val)
+		if len(history) > rule.cond.n {
+			history = history[len(history)-rule.cond.n:]
+		}
+		as.state.History[key] = history
+	}
+
+	if !ok {
+		return nil
+	}
+
+	firing := rule.cond.holds(val, threshold)
+	if firing == as.state.Firing[key] {
+		return nil
+	}
+	as.state.Firing[key] = firing
+
+	state := "resolved"
+	if firing {
+		state = "firing"
+	}
+	return &alert{
+		Rule:        rule.Name,
+		Query:       rule.Query,
+		State:       state,
+		Group:       group,
+		Condition:   rule.Condition,
+		Value:       val,
+		Threshold:   threshold,
+		WindowStart: result.start,
+		WindowEnd:   result.end,
+	}
+}
+
+func (as *alertSink) deliver(a *alert) error {
+	encoded, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	if *alertWebhook == "" {
+		log.Printf("ALERT %s", encoded)
+		return nil
+	}
+
+	resp, err := as.client.Post(*alertWebhook, "application/json", bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %v", resp.Status)
+	}
+	return nil
+}
+
+// groupOf returns the dimension columns of a row, everything except the
+// value columns
+func groupOf(row map[string]interface{}, valueCols []string) map[string]string {
+	skip := make(map[string]bool)
+	for _, col := range valueCols {
+		skip[col] = true
+	}
+
+	group := make(map[string]string)
+	for col, v := range row {
+		if !skip[col] {
+			group[col] = n1ql.String(v)
+		}
+	}
+	return group
+}
+
+func groupKey(group map[string]string) string {
+	keys := make([]string, 0, len(group))
+	for k, v := range group {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var backfillFrom = flag.String("from", "", "backfill windows from this time, a date, RFC3339 time or unix seconds")
+var backfillTo = flag.String("to", "", "end of the backfill, defaults to lag seconds ago")
+var backfillStep = flag.Duration("step", 0, "window size of the backfill, defaults to the refresh interval of each query")
+var backfillConcurrency = flag.Int("concurrency", 2, "number of backfill windows run at the same time")
+
+// parseTime accepts a date, an RFC3339 time or unix seconds
+func parseTime(s string) (int64, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %q, expected e.g. 2017-06-01, 2017-06-01T12:00:00Z or unix seconds", s)
+}
+
+// step is the backfill window size of the query in seconds
+func (q *queryDef) step() int64 {
+	if *backfillStep > 0 {
+		return int64(*backfillStep / time.Second)
+	}
+	return q.interval()
+}
+
+// runBackfill runs every query over the past windows covering [from, to),
+// writing the results to the sinks like any other run except the alerts,
+// which aren't evaluated over past windows. Windows that aren't
+// complete yet are left out. Windows are aligned to the step the same way
+// the scheduler aligns them, so backfilled results replace the ones missed
+// rather than sitting beside them.
+func runBackfill(defs []*queryDef, jobs chan<- job) {
+	from, err := parseTime(*backfillFrom)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// windows ending later than this aren't complete yet
+	latest := time.Now().Unix() - int64(*lag)
+
+	to := latest
+	if *backfillTo != "" {
+		if to, err = parseTime(*backfillTo); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if to <= from {
+		log.Fatalf("Nothing to backfill, %v is not after %v", time.Unix(to, 0), time.Unix(from, 0))
+	}
+	if *backfillConcurrency < 1 {
+		log.Fatalf("-concurrency must be at least 1")
+	}
+
+	sem := make(chan struct{}, *backfillConcurrency)
+	var pending sync.WaitGroup
+
+	for _, def := range defs {
+		step := def.step()
+		if step <= 0 {
+			log.Fatalf("Query %v: invalid step %v", def.key(), step)
+		}
+
+		first := from - from%step
+		log.Printf("Backfilling %v from %v in windows of %vs", def.key(), time.Unix(first, 0), step)
+
+		for start := first; start < to && start+step <= latest; start += step {
+			sem <- struct{}{}
+			pending.Add(1)
+
+			go func(def *queryDef, start, end int64) {
+				defer pending.Done()
+				defer func() { <-sem }()
+
+				reply := make(chan *queryResult, 1)
+				jobs <- job{def: def, start: start, end: end, reply: reply}
+				emit(<-reply)
+			}(def, start, start+step)
+		}
+	}
+
+	pending.Wait()
+	runSummary.print()
+}
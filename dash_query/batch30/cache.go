@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+)
+
+var cacheTTL = flag.Duration("cacheTTL", 0, "reuse the result of a query run with the same text and parameters within this long, 0 to disable")
+
+// cachedQuery is the result of one execution of a query. done is closed once
+// it has finished, requests arriving before that wait for it.
+type cachedQuery struct {
+	key     string
+	done    chan struct{}
+	columns []string
+	rows    []map[string]interface{}
+	metrics n1ql.Metrics
+	err     error
+	expires time.Time
+
+	// The execution isn't tied to the context of any one request. It runs
+	// until the latest deadline of the requests waiting for it, with no
+	// limit if one of them has none, and is cancelled once they have all
+	// given up. Guarded by the cache mutex.
+	cancel    context.CancelFunc
+	timer     *time.Timer
+	deadline  time.Time
+	unbounded bool
+	waiters   int
+}
+
+// queryCache collapses identical queries, the same text with the same
+// parameters, into a single request to the query service. Successful
+// results are kept for -cacheTTL, so panels sharing a query don't query the
+// service again. Comparison windows only reuse a result if -cacheTTL is at
+// least their offset.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedQuery
+}
+
+var cache = &queryCache{entries: make(map[string]*cachedQuery)}
+
+func cacheKey(text string, args []interface{}) string {
+	encoded, err := json.Marshal(args)
+	if err != nil {
+		return ""
+	}
+	return text + "\x00" + string(encoded)
+}
+
+// query runs the query unless the same one is running or cached. cached is
+// true if the result came from another request. Each request waits at most
+// until its own ctx is done. Callers get their own copy of the rows to
+// change.
+func (c *queryCache) query(ctx context.Context, client *n1ql.Client, text string, args []interface{}) ([]string, []map[string]interface{}, n1ql.Metrics, bool, error) {
+	key := cacheKey(text, args)
+	if key == "" {
+		cols, rows, metrics, err := client.QueryWithMetrics(ctx, text, args...)
+		return cols, rows, metrics, false, err
+	}
+
+	c.mu.Lock()
+	c.expire()
+	e, shared := c.entries[key]
+	if !shared {
+		e = c.start(key, client, text, args)
+	}
+	e.join(ctx)
+	c.mu.Unlock()
+
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		c.leave(e)
+		return nil, nil, n1ql.Metrics{}, false, ctx.Err()
+	}
+	if e.err != nil && ctx.Err() != nil {
+		return nil, nil, n1ql.Metrics{}, false, ctx.Err()
+	}
+	return append([]string(nil), e.columns...), copyRows(e.rows), e.metrics, shared, e.err
+}
+
+// start runs the query in the background, c.mu must be held
+func (c *queryCache) start(key string, client *n1ql.Client, text string, args []interface{}) *cachedQuery {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &cachedQuery{key: key, done: make(chan struct{}), cancel: cancel}
+	c.entries[key] = e
+
+	go func() {
+		columns, rows, metrics, err := client.QueryWithMetrics(ctx, text, args...)
+		if err != nil && ctx.Err() != nil {
+			// cancelled by the timer, or nobody is waiting any more
+			err = context.DeadlineExceeded
+		}
+
+		c.mu.Lock()
+		e.columns, e.rows, e.metrics, e.err = columns, rows, metrics, err
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+		if c.entries[key] == e {
+			if e.err != nil || *cacheTTL <= 0 {
+				// only requests already waiting share a failure or an uncached result
+				delete(c.entries, key)
+			} else {
+				e.expires = time.Now().Add(*cacheTTL)
+			}
+		}
+		c.mu.Unlock()
+		cancel()
+		close(e.done)
+	}()
+
+	return e
+}
+
+// join extends the execution to the deadline of ctx, c.mu must be held
+func (e *cachedQuery) join(ctx context.Context) {
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+
+	e.waiters++
+	d, ok := ctx.Deadline()
+	switch {
+	case e.unbounded:
+	case !ok:
+		e.unbounded = true
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	case e.timer == nil:
+		e.deadline = d
+		e.timer = time.AfterFunc(time.Until(d), e.cancel)
+	case d.After(e.deadline):
+		e.deadline = d
+		e.timer.Reset(time.Until(d))
+	}
+}
+
+// leave is called by a request that gave up waiting. The execution is
+// cancelled when nobody is left waiting for it, and forgotten so the next
+// request starts afresh.
+func (c *queryCache) leave(e *cachedQuery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return
+	default:
+	}
+	if e.waiters--; e.waiters == 0 {
+		e.cancel()
+		if c.entries[e.key] == e {
+			delete(c.entries, e.key)
+		}
+	}
+}
+
+// expire drops cached results past their TTL, c.mu must be held
+func (c *queryCache) expire() {
+	now := time.Now()
+	for key, e := range c.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// copyRows copies the row maps, the values themselves are never changed
+func copyRows(rows []map[string]interface{}) []map[string]interface{} {
+	if rows == nil {
+		return nil
+	}
+	copied := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		copied[i] = make(map[string]interface{}, len(row))
+		for k, v := range row {
+			copied[i][k] = v
+		}
+	}
+	return copied
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+	"gopkg.in/yaml.v2"
+)
+
+// queryDef is one entry of the query catalog. The query refers to its
+// parameters by name, e.g. $start, $end and $game_id. start and end are the
+// bounds of the window being queried, the rest come from params.
+type queryDef struct {
+	Name    string                 `yaml:"name" json:"name"`
+	Query   string                 `yaml:"query" json:"query"`
+	Params  map[string]interface{} `yaml:"params" json:"params"`
+	Columns []string               `yaml:"columns" json:"columns"`
+	Refresh int                    `yaml:"refresh" json:"refresh"` // seconds, defaults to -diff
+	Timeout int                    `yaml:"timeout" json:"timeout"` // seconds, defaults to -timeout
+	Retries *int                   `yaml:"retries" json:"retries"` // defaults to -retries
+	Compare []string               `yaml:"compare" json:"compare"` // offsets such as 1d or 7d, defaults to -compare
+
+	AllowPrimaryScan bool `yaml:"allowPrimaryScan" json:"allowPrimaryScan"` // run even if -validate finds no index
+
+	text string   // query with the named parameters replaced by ?
+	args []string // parameter names in positional order
+	offs []offset // comparison windows
+
+	tags map[string]interface{} // dimension values this copy of the query runs with
+	id   string                 // name and the tags that tell the copies apart
+}
+
+// catalog is the query catalog file. dimensions lists the values of
+// parameters such as game_id that each query referring to them is run for.
+type catalog struct {
+	Queries    []*queryDef              `yaml:"queries" json:"queries"`
+	Dimensions map[string][]interface{} `yaml:"dimensions" json:"dimensions"`
+}
+
+// loadCatalog reads a YAML or JSON query catalog. Any other file is read as
+// the old format of one query per line with two ? placeholders for the
+// start and end of the window, named query1, query2 ...
+func loadCatalog(path string) ([]*queryDef, map[string][]interface{}, error) {
+	var c catalog
+
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".yaml", ".yml", ".json":
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ext == ".json" {
+			err = json.Unmarshal(data, &c)
+		} else {
+			err = yaml.Unmarshal(data, &c)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing %v: %v", path, err)
+		}
+		for _, q := range c.Queries {
+			q.text, q.args = bindNames(q.Query)
+		}
+
+	default:
+		lines, err := n1ql.ReadQueries(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, line := range lines {
+			c.Queries = append(c.Queries, &queryDef{
+				Name:  fmt.Sprintf("query%d", i+1),
+				Query: line,
+				text:  line,
+				args:  []string{"start", "end"},
+			})
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, q := range c.Queries {
+		if q.Name == "" || q.Query == "" {
+			return nil, nil, fmt.Errorf("%v: every query needs a name and query text", path)
+		}
+		if names[q.Name] {
+			return nil, nil, fmt.Errorf("%v: duplicate query name %v", path, q.Name)
+		}
+		names[q.Name] = true
+	}
+
+	return c.Queries, c.Dimensions, nil
+}
+
+// selectQueries returns the queries named in the comma separated list, or
+// all of them if the list is empty
+func selectQueries(queries []*queryDef, list string) ([]*queryDef, error) {
+	if list == "" {
+		return queries, nil
+	}
+
+	byName := make(map[string]*queryDef)
+	for _, q := range queries {
+		byName[q.Name] = q
+	}
+
+	selected := make([]*queryDef, 0)
+	for _, name := range strings.Split(list, ",") {
+		q, ok := byName[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown query %v", name)
+		}
+		selected = append(selected, q)
+	}
+	return selected, nil
+}
+
+// bind returns the positional arguments for running the query over the
+// window [start, end)
+func (q *queryDef) bind(start, end int64) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(q.args))
+	for _, name := range q.args {
+		switch name {
+		case "start":
+			args = append(args, start)
+		case "end":
+			args = append(args, end)
+		default:
+			val, ok := q.tags[name]
+			if !ok {
+				val, ok = q.Params[name]
+			}
+			if !ok {
+				return nil, fmt.Errorf("query %v: no value for parameter $%v", q.Name, name)
+			}
+			args = append(args, val)
+		}
+	}
+	return args, nil
+}
+
+// timeout is how long a query may run before it is abandoned
+func (q *queryDef) timeout() time.Duration {
+	if q.Timeout > 0 {
+		return time.Duration(q.Timeout) * time.Second
+	}
+	return time.Duration(*timeout) * time.Second
+}
+
+// retries is how many times a failed query is run again
+func (q *queryDef) retries() int {
+	if q.Retries != nil {
+		return *q.Retries
+	}
+	return *retries
+}
+
+// checkColumns warns when a row is missing one of the expected columns
+func (q *queryDef) checkColumns(rows []map[string]interface{}) error {
+	if len(q.Columns) == 0 || len(rows) == 0 {
+		return nil
+	}
+	for _, col := range q.Columns {
+		if _, ok := rows[0][col]; !ok {
+			return fmt.Errorf("query %v: column %v missing from result", q.Name, col)
+		}
+	}
+	return nil
+}
+
+// bindNames replaces each $name parameter with a ? placeholder and returns
+// the names in the order they appear. Quoted strings, identifiers and
+// comments are left untouched.
+func bindNames(query string) (string, []string) {
+	var out strings.Builder
+	names := make([]string, 0)
+
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			out.WriteByte(c)
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+			out.WriteByte(c)
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			out.WriteString(query[i : i+end])
+			i += end - 1
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				end = len(query) - i
+			} else {
+				end += 4
+			}
+			out.WriteString(query[i : i+end])
+			i += end - 1
+		case c == '$' && i+1 < len(query) && isIdentStart(query[i+1]):
+			j := i + 1
+			for j < len(query) && isIdent(query[j]) {
+				j++
+			}
+			names = append(names, query[i+1:j])
+			out.WriteByte('?')
+			i = j - 1
+		default:
+			out.WriteByte(c)
+		}
+	}
+
+	return out.String(), names
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
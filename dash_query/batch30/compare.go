@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+)
+
+var compareWith = flag.String("compare", "", "comma separated offsets such as 1d,7d to compare each window with, e.g. day-over-day and week-over-week")
+
+// offset is how far back a comparison window is
+type offset struct {
+	label   string
+	seconds int64
+}
+
+// parseOffset parses a number followed by s, m, h, d or w
+func parseOffset(s string) (offset, error) {
+	s = strings.TrimSpace(s)
+	units := map[byte]int64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 7 * 86400}
+	if len(s) < 2 || units[s[len(s)-1]] == 0 {
+		return offset{}, fmt.Errorf("invalid offset %q, expected e.g. 1d or 7d", s)
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return offset{}, fmt.Errorf("invalid offset %q, expected e.g. 1d or 7d", s)
+	}
+	return offset{label: s, seconds: n * units[s[len(s)-1]]}, nil
+}
+
+// parseCompare sets the comparison offsets of each query from its catalog
+// entry or -compare
+func parseCompare(defs []*queryDef) error {
+	for _, def := range defs {
+		list := def.Compare
+		if list == nil && *compareWith != "" {
+			list = strings.Split(*compareWith, ",")
+		}
+		def.offs = nil
+		for _, s := range list {
+			off, err := parseOffset(s)
+			if err != nil {
+				return fmt.Errorf("query %v: %v", def.Name, err)
+			}
+			def.offs = append(def.offs, off)
+		}
+	}
+	return nil
+}
+
+func (q *queryDef) offsets() []offset {
+	return q.offs
+}
+
+// compare adds the value of each dimension group in the past window next to
+// the current one, as <val>_<label>, with the change in percent as
+// delta_pct_<label>. Groups only present in the past get a current value of 0.
+// The comparison columns are null if the past query failed, the group had no
+// row then or its value was 0.
+func compare(result, past *queryResult, label string) {
+	pastCol := *valueColumn + "_" + label
+	deltaCol := "delta_pct_" + label
+
+	valueCols := result.valueColumns()
+	key := func(row map[string]interface{}) string {
+		return groupKey(groupOf(row, valueCols))
+	}
+
+	pastRows := make(map[string]map[string]interface{})
+	if past.err == nil {
+		for _, row := range past.rows {
+			pastRows[key(row)] = row
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, row := range result.rows {
+		k := key(row)
+		seen[k] = true
+		setComparison(row, pastRows[k], pastCol, deltaCol)
+	}
+
+	// groups that disappeared since the past window
+	isValue := make(map[string]bool)
+	for _, col := range valueCols {
+		isValue[col] = true
+	}
+	for k, pastRow := range pastRows {
+		if seen[k] {
+			continue
+		}
+		// keep the typed dimension values so the row matches live ones
+		row := make(map[string]interface{})
+		for col, v := range pastRow {
+			if !isValue[col] {
+				row[col] = v
+			}
+		}
+		row[*valueColumn] = int64(0)
+		setComparison(row, pastRow, pastCol, deltaCol)
+		result.rows = append(result.rows, row)
+	}
+
+	result.columns = append(result.columns, pastCol, deltaCol)
+	result.compared = append(result.compared, pastCol, deltaCol)
+}
+
+func setComparison(row, pastRow map[string]interface{}, pastCol, deltaCol string) {
+	row[pastCol] = nil
+	row[deltaCol] = nil
+	if pastRow == nil {
+		return
+	}
+
+	prev, ok := n1ql.Float(pastRow[*valueColumn])
+	if !ok {
+		return
+	}
+	row[pastCol] = pastRow[*valueColumn]
+
+	cur, ok := n1ql.Float(row[*valueColumn])
+	if ok && prev != 0 {
+		row[deltaCol] = (cur - prev) / prev * 100
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+)
+
+var dimensionList = flag.String("dimensions", "", "values of query parameters to run each query for, e.g. game_id=3,5,7;installOS=android,ios, overriding the catalog dimensions")
+
+// parseDimensions parses name=value,value;name=value lists. Values that
+// look like numbers are passed to the query as numbers.
+func parseDimensions(s string) (map[string][]interface{}, error) {
+	dims := make(map[string][]interface{})
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || name == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid dimension %q, expected e.g. game_id=3,5,7", part)
+		}
+		for _, v := range strings.Split(kv[1], ",") {
+			dims[name] = append(dims[name], parseParam(strings.TrimSpace(v)))
+		}
+	}
+	return dims, nil
+}
+
+func parseParam(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	return s
+}
+
+// expandDimensions returns a copy of each query for every combination of
+// the dimension values it refers to. A query that sets the parameter in its
+// own params keeps that value and runs once. The values are the tags of the
+// copy, added as columns to every row of its results. Only dimensions with
+// more than one value become part of the query key, so a catalog with a
+// single game keeps the keys, documents and state it had before.
+func expandDimensions(defs []*queryDef, dims map[string][]interface{}) []*queryDef {
+	names := make([]string, 0, len(dims))
+	for name := range dims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	expanded := make([]*queryDef, 0, len(defs))
+	for _, def := range defs {
+		variants := []*queryDef{def}
+		for _, name := range names {
+			if _, pinned := def.Params[name]; pinned || !def.uses(name) {
+				continue
+			}
+
+			next := make([]*queryDef, 0, len(variants)*len(dims[name]))
+			for _, v := range variants {
+				for _, val := range dims[name] {
+					c := *v
+					c.tags = make(map[string]interface{}, len(v.tags)+1)
+					for k, tv := range v.tags {
+						c.tags[k] = tv
+					}
+					c.tags[name] = val
+					next = append(next, &c)
+				}
+			}
+			variants = next
+		}
+
+		for _, v := range variants {
+			keyTags := make(map[string]interface{})
+			for name, val := range v.tags {
+				if len(dims[name]) > 1 {
+					keyTags[name] = val
+				}
+			}
+			v.id = tagged(v.Name, keyTags)
+		}
+		expanded = append(expanded, variants...)
+	}
+	return expanded
+}
+
+// uses reports whether the query refers to the parameter
+func (q *queryDef) uses(param string) bool {
+	for _, name := range q.args {
+		if name == param {
+			return true
+		}
+	}
+	return false
+}
+
+// key identifies the query and its tags, e.g. user_load;game_id=3, and is
+// used wherever results of the same query for different games must be told
+// apart
+func (q *queryDef) key() string {
+	if q.id != "" {
+		return q.id
+	}
+	return q.Name
+}
+
+func (r *queryResult) key() string {
+	if r.id != "" {
+		return r.id
+	}
+	return r.name
+}
+
+func tagged(name string, tags map[string]interface{}) string {
+	if len(tags) == 0 {
+		return name
+	}
+	return name + ";" + strings.Replace(groupKey(tagStrings(tags)), ",", ";", -1)
+}
+
+func tagStrings(tags map[string]interface{}) map[string]string {
+	s := make(map[string]string, len(tags))
+	for k, v := range tags {
+		s[k] = n1ql.String(v)
+	}
+	return s
+}
+
+// addTags adds the tags of the query as columns of every row
+func addTags(result *queryResult) {
+	if len(result.tags) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(result.tags))
+	for name := range result.tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if len(result.columns) > 0 && !contains(result.columns, name) {
+			result.columns = append(result.columns, name)
+		}
+		for _, row := range result.rows {
+			if _, ok := row[name]; !ok {
+				row[name] = result.tags[name]
+			}
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
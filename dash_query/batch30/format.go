@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var format = flag.String("format", "json", "output format: json, ndjson, csv, graphite or influx")
+var valueColumn = flag.String("valueColumn", "val", "column holding the metric value for graphite and influx, the other columns become tags")
+var metricPrefix = flag.String("metricPrefix", "batch30", "prefix of graphite metric names")
+
+// formatSink writes results to w in one of the -format output formats.
+// Results from concurrent queries are written whole, never interleaved.
+type formatSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	header string // last csv header written
+}
+
+func newFormatSink(format string, w io.Writer) (*formatSink, error) {
+	switch format {
+	case "json", "ndjson", "csv", "graphite", "influx":
+		return &formatSink{w: w, format: format}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %v", format)
+}
+
+func (fs *formatSink) write(result *queryResult) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if result.err != nil {
+		return fs.writeError(result)
+	}
+
+	switch fs.format {
+	case "ndjson":
+		return fs.writeNDJSON(result)
+	case "csv":
+		return fs.writeCSV(result)
+	case "graphite":
+		return fs.writeMetrics(result, graphiteLine)
+	case "influx":
+		return fs.writeMetrics(result, influxLine)
+	default:
+		resultStr, err := json.MarshalIndent(result.rows, "", "    ")
+		if err != nil {
+			return err
+		}
+		metricsStr, err := json.Marshal(newMetricsDoc(result))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fs.w, "Query %v: %v \n Metrics %s \n Result %s \n", result.key(), result.query, metricsStr, resultStr)
+		return err
+	}
+}
+
+// writeError reports a failed query in the json formats. The tabular and
+// metric formats have nowhere to put it and leave the query out.
+func (fs *formatSink) writeError(result *queryResult) error {
+	switch fs.format {
+	case "json":
+		_, err := fmt.Fprintf(fs.w, "Query %v: %v \n Error %v \n", result.key(), result.query, result.err)
+		return err
+	case "ndjson":
+		return json.NewEncoder(fs.w).Encode(withTags(result, map[string]interface{}{
+			"query":       result.name,
+			"windowStart": result.start,
+			"windowEnd":   result.end,
+			"error":       result.err.Error(),
+		}))
+	}
+	return nil
+}
+
+// withTags adds the tags of the result to an ndjson object
+func withTags(result *queryResult, obj map[string]interface{}) map[string]interface{} {
+	for k, v := range result.tags {
+		obj[k] = v
+	}
+	return obj
+}
+
+// writeNDJSON writes one object per row with the query name and window
+// added, followed by an object with the query metrics
+func (fs *formatSink) writeNDJSON(result *queryResult) error {
+	enc := json.NewEncoder(fs.w)
+	defer enc.Encode(withTags(result, map[string]interface{}{
+		"query":       result.name,
+		"windowStart": result.start,
+		"windowEnd":   result.end,
+		"metrics":     newMetricsDoc(result),
+	}))
+
+	for _, r := range result.rows {
+		row := make(map[string]interface{})
+		for k, v := range r {
+			row[k] = v
+		}
+		row["query"] = result.name
+		row["windowStart"] = result.start
+		row["windowEnd"] = result.end
+		if err := enc.Encode(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSV writes a row per result row, repeating the header whenever the
+// columns differ from the previous result
+func (fs *formatSink) writeCSV(result *queryResult) error {
+	cols := resultColumns(result)
+	header := append([]string{"query", "windowStart", "windowEnd"}, cols...)
+
+	cw := csv.NewWriter(fs.w)
+	if joined := strings.Join(header, ","); joined != fs.header {
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		fs.header = joined
+	}
+
+	for _, row := range result.rows {
+		record := []string{result.name, strconv.FormatInt(result.start, 10), strconv.FormatInt(result.end, 10)}
+		for _, col := range cols {
+			record = append(record, formatValue(row[col]))
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// metricField is a named value written by the metric formats
+type metricField struct {
+	name, value string
+}
+
+// writeMetrics writes the value column, and any comparison columns, of each
+// row as metrics with the remaining columns as tags
+func (fs *formatSink) writeMetrics(result *queryResult, line func(*queryResult, []string, map[string]interface{}, []metricField) string) error {
+	values := result.valueColumns()
+	isValue := make(map[string]bool)
+	for _, col := range values {
+		isValue[col] = true
+	}
+
+	tags := make([]string, 0)
+	for _, col := range resultColumns(result) {
+		if !isValue[col] {
+			tags = append(tags, col)
+		}
+	}
+	sort.Strings(tags)
+
+	for _, row := range result.rows {
+		fields := make([]metricField, 0, len(values))
+		for _, col := range values {
+			if val, ok := numericValue(row[col]); ok {
+				fields = append(fields, metricField{col, val})
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if _, err := io.WriteString(fs.w, line(result, tags, row, fields)); err != nil {
+			return err
+		}
+	}
+
+	// self monitoring, e.g. batch30.self.user_load;game_id=3;metric=duration_ms
+	self := &queryResult{name: "self." + result.name, start: result.start}
+	selfTags := []string{"metric"}
+	for tag := range result.tags {
+		selfTags = append(selfTags, tag)
+	}
+	sort.Strings(selfTags)
+
+	for _, m := range metricLines(result) {
+		row := withTags(result, map[string]interface{}{"metric": m[0]})
+		if _, err := io.WriteString(fs.w, line(self, selfTags, row, []metricField{{*valueColumn, m[1]}})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// graphiteLine formats a row in the tagged graphite plaintext protocol, one
+// line per field, e.g. batch30.user_load;appver=1.2;os=android 42 1500000000.
+// Fields other than the value column are appended to the metric name.
+func graphiteLine(result *queryResult, tags []string, row map[string]interface{}, fields []metricField) string {
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(*metricPrefix + "." + result.name)
+		if f.name != *valueColumn {
+			b.WriteString("." + f.name)
+		}
+		for _, tag := range tags {
+			b.WriteString(";" + tag + "=" + graphiteEscape(formatValue(row[tag])))
+		}
+		fmt.Fprintf(&b, " %s %d\n", f.value, result.start)
+	}
+	return b.String()
+}
+
+// influxLine formats a row in the influxdb line protocol,
+// e.g. user_load,appver=1.2,os=android val=42 1500000000000000000
+func influxLine(result *queryResult, tags []string, row map[string]interface{}, fields []metricField) string {
+	var b strings.Builder
+	b.WriteString(influxEscape(result.name))
+	for _, tag := range tags {
+		b.WriteString("," + influxEscape(tag) + "=" + influxEscape(formatValue(row[tag])))
+	}
+	for i, f := range fields {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		b.WriteString(sep + influxEscape(f.name) + "=" + f.value)
+	}
+	fmt.Fprintf(&b, " %d\n", result.start*1e9)
+	return b.String()
+}
+
+// graphite tag values can't be empty or contain ; ~ or spaces
+func graphiteEscape(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.NewReplacer(";", "_", "~", "_", " ", "_").Replace(s)
+}
+
+// influx tag keys and values escape commas, equals signs and spaces
+func influxEscape(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `).Replace(s)
+}
+
+// resultColumns returns the columns of a result, taken from the first row
+// in sorted order if the driver didn't report them
+func resultColumns(result *queryResult) []string {
+	if len(result.columns) > 0 || len(result.rows) == 0 {
+		return result.columns
+	}
+	cols := make([]string, 0)
+	for col := range result.rows[0] {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// numericValue formats v as a metric value, ok is false if it isn't a number
+func numericValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case int, int64, int32, uint64:
+		return fmt.Sprint(v), true
+	case string:
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return v, true
+		}
+	}
+	return "", false
+}
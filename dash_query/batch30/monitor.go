@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var slowQuery = flag.Duration("slowQuery", 30*time.Second, "warn about queries taking longer than this, 0 to disable")
+
+// metricsDoc is how the query metrics appear in json output and stored documents
+type metricsDoc struct {
+	DurationMs      float64 `json:"durationMs"` // as measured by batch30, including retries
+	ElapsedTimeMs   float64 `json:"elapsedTimeMs"`
+	ExecutionTimeMs float64 `json:"executionTimeMs"`
+	ResultCount     int64   `json:"resultCount"`
+	ResultSize      int64   `json:"resultSize"`
+	Rows            int     `json:"rows"`
+	Attempts        int     `json:"attempts"`
+	Cached          bool    `json:"cached,omitempty"`
+}
+
+func newMetricsDoc(result *queryResult) *metricsDoc {
+	return &metricsDoc{
+		DurationMs:      ms(result.duration),
+		ElapsedTimeMs:   ms(result.metrics.ElapsedTime),
+		ExecutionTimeMs: ms(result.metrics.ExecutionTime),
+		ResultCount:     result.metrics.ResultCount,
+		ResultSize:      result.metrics.ResultSize,
+		Rows:            len(result.rows),
+		Attempts:        result.attempts,
+		Cached:          result.cached,
+	}
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// checkSlow warns when a query ran longer than -slowQuery
+func checkSlow(result *queryResult) {
+	if *slowQuery > 0 && result.duration > *slowQuery {
+		log.Printf("Slow query %v took %v (service elapsed %v, execution %v), %v rows, %v bytes",
+			result.key(), result.duration, result.metrics.ElapsedTime, result.metrics.ExecutionTime,
+			result.metrics.ResultCount, result.metrics.ResultSize)
+	}
+}
+
+// metricLines returns the self monitoring metrics of a result as
+// name/value pairs for the graphite and influx formats
+func metricLines(result *queryResult) [][2]string {
+	m := newMetricsDoc(result)
+	return [][2]string{
+		{"duration_ms", fmt.Sprint(m.DurationMs)},
+		{"elapsed_ms", fmt.Sprint(m.ElapsedTimeMs)},
+		{"execution_ms", fmt.Sprint(m.ExecutionTimeMs)},
+		{"result_count", fmt.Sprint(m.ResultCount)},
+		{"result_size", fmt.Sprint(m.ResultSize)},
+	}
+}
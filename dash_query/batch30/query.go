@@ -1,154 +1,293 @@
 package main
 
 import (
-	"bufio"
-	"database/sql"
-	"encoding/json"
+	"context"
 	"flag"
-	"fmt"
-	_ "github.com/couchbase/go_n1ql"
 	"log"
 	"os"
 	"runtime"
 	"sync"
 	"time"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
 )
 
 var serverURL = flag.String("server", "http://localhost:8093",
 	"couchbase server URL")
+var creds = n1ql.CredentialFlags()
 var threads = flag.Int("threads", 10, "number of threads")
-var queryFile = flag.String("queryfile", "query_file.txt", "file containing list of select queries")
+var queryFile = flag.String("queryfile", "query_catalog.yaml", "query catalog, or a file containing list of select queries")
+var queryNames = flag.String("queries", "", "comma separated names of the catalog queries to run, default all")
 var diff = flag.Int("diff", 100, "time difference")
 var lag = flag.Int("lag", 60, "time lag in seconds")
+var timeout = flag.Int("timeout", 300, "default query timeout in seconds")
+var retries = flag.Int("retries", 1, "default number of times a failed query is retried")
+var retryDelay = flag.Duration("retryDelay", 5*time.Second, "delay before retrying a failed query, doubled on each retry")
 
 var wg sync.WaitGroup
 
+// job is one catalog query to run over a window. The result is sent on reply.
+type job struct {
+	def        *queryDef
+	start, end int64
+	reply      chan *queryResult
+}
+
+// queryResult holds the rows returned for one catalog query and window
+type queryResult struct {
+	name       string
+	id         string // the query's key()
+	query      string
+	start, end int64
+	executedAt time.Time
+	duration   time.Duration
+	columns    []string
+	rows       []map[string]interface{}
+	tags       map[string]interface{} // dimension values, also added as columns
+	compared   []string               // columns added by -compare
+	metrics    n1ql.Metrics           // reported by the query service for the last attempt
+	attempts   int
+	cached     bool  // rows came from the cache or another run of the same query
+	err        error // set if every attempt failed, rows is then empty
+}
+
+// valueColumns are the columns holding values rather than dimensions
+func (r *queryResult) valueColumns() []string {
+	return append([]string{*valueColumn}, r.compared...)
+}
+
+// sink receives every query result
+type sink interface {
+	write(result *queryResult) error
+}
+
+var sinks []sink
+
 func main() {
 
 	flag.Parse()
 
+	if *threads < 1 {
+		log.Fatalf("Need at least one thread, got %v", *threads)
+	}
+
 	// set GO_MAXPROCS to the number of threads
 	runtime.GOMAXPROCS(*threads)
 
-	queryLines, err := readLines(*queryFile)
+	defs, dims, err := loadCatalog(*queryFile)
 	if err != nil {
-		log.Fatal(" Unable to read from file %s, Error %v", *queryFile, err)
+		log.Fatalf(" Unable to read from file %s, Error %v", *queryFile, err)
 	}
 
-	for i := 0; i < *threads; i++ {
-		wg.Add(1)
-		go runQuery(*serverURL, queryLines, i)
+	defs, err = selectQueries(defs, *queryNames)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	wg.Wait()
-}
+	if err = parseCompare(defs); err != nil {
+		log.Fatal(err)
+	}
 
-// readLines reads a whole file into memory
-// and returns a slice of its lines.
-func readLines(path string) ([]string, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if *dimensionList != "" {
+		if dims, err = parseDimensions(*dimensionList); err != nil {
+			log.Fatal(err)
+		}
 	}
-	defer file.Close()
+	defs = expandDimensions(defs, dims)
 
-	var lines []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+	credList, err := creds.Load()
+	if err != nil {
+		log.Fatal(err)
 	}
-	return lines, scanner.Err()
-}
 
-func runQuery(server string, queryLines []string, offset int) {
+	// the server side timeout is shared, per query timeouts are enforced here
+	serverTimeout := time.Duration(0)
+	for _, def := range defs {
+		if def.timeout() > serverTimeout {
+			serverTimeout = def.timeout()
+		}
+	}
 
-	n1ql, err := sql.Open("n1ql", *serverURL)
+	client, err := n1ql.Open(n1ql.Config{
+		Server:  *serverURL,
+		Timeout: serverTimeout,
+		Creds:   credList,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = n1ql.Ping()
+	stdout, err := newFormatSink(*format, os.Stdout)
 	if err != nil {
 		log.Fatal(err)
 	}
+	sinks = append(sinks, stdout, runSummary)
 
-	// Set query parameters
-	os.Setenv("n1ql_timeout", "1000s")
-	ac := []byte(`[{"user": "admin:Administrator", "pass": "asdasd"}]`)
-	os.Setenv("n1ql_creds", string(ac))
-
-	results := make([]interface{}, 0)
-
-	for i, query := range queryLines {
-
-		if i != offset {
-			continue
-		}
-
-		var rows *sql.Rows
-
-		startTime := time.Now()
-		rows, err = n1ql.Query(query, startTime.Unix()-int64(*diff)-int64(*lag), startTime.Unix()-int64(*lag))
+	if *cbBucket != "" {
+		store, err := newCouchbaseSink(*cbServer, *cbBucket)
 		if err != nil {
-			log.Fatal("Error Query Line ", err, query, i)
+			log.Fatal(err)
 		}
+		sinks = append(sinks, store)
+	}
 
-		defer rows.Close()
-		cols, err := rows.Columns()
+	// backfilled windows are old and out of order, alerting on them would
+	// fire and resolve alerts for the past and pollute the alert history
+	if *rulesFile != "" && *backfillFrom != "" {
+		log.Printf("Alerting rules are not evaluated while backfilling")
+	} else if *rulesFile != "" {
+		rules, err := loadRules(*rulesFile, defs)
 		if err != nil {
-			log.Printf("No columns returned %v", err)
-			break
+			log.Fatal(err)
 		}
-		if cols == nil {
-			log.Printf("No columns returned")
-			break
+		alerts, err := newAlertSink(rules)
+		if err != nil {
+			log.Fatalf("Unable to read alert state %v, Error %v", *alertState, err)
 		}
+		sinks = append(sinks, alerts)
+	}
 
-		vals := make([]interface{}, len(cols))
-		for i := 0; i < len(cols); i++ {
-			vals[i] = new(interface{})
+	if *httpAddr != "" {
+		history := newHistorySink(defs, *historySize)
+		sinks = append(sinks, history)
+		history.serve(*httpAddr)
+	}
+
+	// rules and the history still know the refused queries, they just never run
+	if *validate {
+		if defs = validateQueries(client, defs); len(defs) == 0 {
+			log.Fatal("No queries left to run")
 		}
+	}
 
-		for rows.Next() {
-			row := make(map[string]interface{})
-			err = rows.Scan(vals...)
-			if err != nil {
-				fmt.Println(err)
-				continue
-			}
-			for i := 0; i < len(vals); i++ {
-				row[cols[i]] = returnValue(vals[i].(*interface{}))
-			}
-			results = append(results, row)
+	jobs := make(chan job)
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go worker(client, jobs)
+	}
+
+	switch {
+	case *backfillFrom != "":
+		runBackfill(defs, jobs)
+	case *schedule:
+		runScheduler(defs, jobs)
+	default:
+		runOnce(defs, jobs)
+	}
+
+	close(jobs)
+	wg.Wait()
+}
+
+// runOnce runs every query once over the window ending lag seconds ago and
+// emits the results in catalog order
+func runOnce(defs []*queryDef, jobs chan<- job) {
+
+	// every query runs against the same window
+	now := time.Now().Unix()
+	start, end := now-int64(*diff)-int64(*lag), now-int64(*lag)
+
+	replies := make([]chan *queryResult, len(defs))
+	for i := range defs {
+		replies[i] = make(chan *queryResult, 1)
+	}
 
+	go func() {
+		for i, def := range defs {
+			jobs <- job{def: def, start: start, end: end, reply: replies[i]}
 		}
-		if rows.Err() != nil {
-			log.Printf("Error sanning rows %v", err)
+	}()
+
+	for _, reply := range replies {
+		emit(<-reply)
+	}
+
+	runSummary.print()
+}
+
+// emit hands a result to every sink
+func emit(result *queryResult) {
+	if result.err != nil {
+		log.Printf("Query %v failed after %v attempts, Error %v", result.key(), result.attempts, result.err)
+	}
+	for _, s := range sinks {
+		if err := s.write(result); err != nil {
+			log.Printf("Unable to write result of %v, Error %v", result.key(), err)
 		}
+	}
+}
+
+// worker runs queries from jobs until it is closed
+func worker(client *n1ql.Client, jobs <-chan job) {
+	defer wg.Done()
+
+	for j := range jobs {
+		j.reply <- runQuery(client, j.def, j.start, j.end)
+	}
+}
+
+// runQuery runs the query over the window and, with -compare, over the
+// same window in the past
+func runQuery(client *n1ql.Client, def *queryDef, start, end int64) *queryResult {
 
-		resultStr, _ := json.MarshalIndent(results, "", "    ")
-		fmt.Printf("Query %v \n Result %s \n", query, resultStr)
+	result := execute(client, def, start, end)
+	if result.err != nil {
+		return result
+	}
 
+	for _, off := range def.offsets() {
+		past := execute(client, def, start-off.seconds, end-off.seconds)
+		if past.err != nil {
+			log.Printf("Query %v comparison with %v ago failed, Error %v", def.key(), off.label, past.err)
+		}
+		compare(result, past, off.label)
 	}
 
-	wg.Done()
+	return result
 }
 
-func returnValue(pval *interface{}) interface{} {
-	switch v := (*pval).(type) {
-	case nil:
-		return "NULL"
-	case bool:
-		if v {
-			return true
-		} else {
-			return false
+// execute runs the query with its timeout, retrying failures. Errors are
+// returned in the result so they only affect this query.
+func execute(client *n1ql.Client, def *queryDef, start, end int64) *queryResult {
+
+	result := &queryResult{name: def.Name, id: def.key(), query: def.Query, start: start, end: end, tags: def.tags}
+
+	args, err := def.bind(start, end)
+	if err != nil {
+		result.err = err
+		return result
+	}
+
+	// duration covers every attempt and the delays between them
+	result.executedAt = time.Now()
+
+	delay := *retryDelay
+	for result.attempts = 1; ; result.attempts++ {
+		ctx, cancel := context.WithTimeout(context.Background(), def.timeout())
+		result.columns, result.rows, result.metrics, result.cached, result.err = cache.query(ctx, client, def.text, args)
+		cancel()
+
+		result.duration = time.Since(result.executedAt)
+		if result.err == nil || result.attempts > def.retries() {
+			break
 		}
-	case []byte:
-		return string(v)
-	case time.Time:
-		return v.Format("2006-01-02 15:04:05.999")
-	default:
-		return v
+
+		log.Printf("Query %v attempt %v failed, retrying in %v, Error %v", def.key(), result.attempts, delay, result.err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	if result.err != nil {
+		result.rows = nil
+		return result
 	}
+
+	addTags(result)
+
+	if err = def.checkColumns(result.rows); err != nil {
+		log.Printf("%v", err)
+	}
+
+	checkSlow(result)
+	return result
 }
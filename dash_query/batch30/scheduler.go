@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var schedule = flag.Bool("schedule", false, "keep running, re-executing each query every refresh seconds on consecutive windows")
+var stateFile = flag.String("state", "batch30.state", "file recording the end of the last window run for each query")
+
+// windowState records where the last completed window of each query ended
+// so that a restarted scheduler carries on from there. Windows are half
+// open, [start, end), and each one starts where the previous one ended.
+type windowState struct {
+	mu   sync.Mutex
+	path string
+	ends map[string]int64
+}
+
+func loadState(path string) (*windowState, error) {
+	state := &windowState{path: path, ends: make(map[string]int64)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &state.ends); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// lastEnd returns the end of the last window run for the query, if any
+func (s *windowState) lastEnd(name string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end, ok := s.ends[name]
+	return end, ok
+}
+
+// save records a completed window. The file is replaced atomically so a
+// crash never leaves it half written.
+func (s *windowState) save(name string, end int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ends[name] = end
+	data, err := json.MarshalIndent(s.ends, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// interval is the window size of the query in seconds
+func (q *queryDef) interval() int64 {
+	if q.Refresh > 0 {
+		return int64(q.Refresh)
+	}
+	return int64(*diff)
+}
+
+// runScheduler runs each query on consecutive windows forever
+func runScheduler(defs []*queryDef, jobs chan<- job) {
+	state, err := loadState(*stateFile)
+	if err != nil {
+		log.Fatalf("Unable to read state file %v, Error %v", *stateFile, err)
+	}
+
+	for _, def := range defs {
+		go scheduleQuery(def, jobs, state)
+	}
+
+	// scheduled queries run until the process is stopped
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+	log.Printf("Received %v, stopping", sig)
+	runSummary.print()
+	os.Exit(0)
+}
+
+// scheduleQuery runs one query on back to back windows. A window is only
+// run once its end is lag seconds in the past. After a restart the windows
+// missed while down are run first.
+func scheduleQuery(def *queryDef, jobs chan<- job, state *windowState) {
+	interval := def.interval()
+
+	start, ok := state.lastEnd(def.key())
+	if !ok {
+		// first run, start with the last complete window aligned to the interval
+		now := time.Now().Unix() - int64(*lag)
+		start = now - now%interval - interval
+	}
+
+	reply := make(chan *queryResult, 1)
+	for {
+		end := start + interval
+
+		wait := time.Duration(end+int64(*lag)-time.Now().Unix()) * time.Second
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+
+		jobs <- job{def: def, start: start, end: end, reply: reply}
+		result := <-reply
+		emit(result)
+
+		if result.err != nil {
+			// run the same window again so it isn't missed
+			time.Sleep(*retryDelay)
+			continue
+		}
+
+		if err := state.save(def.key(), end); err != nil {
+			log.Printf("Unable to save state for %v, Error %v", def.key(), err)
+		}
+		start = end
+	}
+}
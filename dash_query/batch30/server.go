@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var httpAddr = flag.String("http", "", "address to serve query results on, e.g. :8080, disabled if empty")
+var historySize = flag.Int("history", 1440, "number of results kept in memory per query for -http")
+
+// ring keeps the last len(results) results of a query
+type ring struct {
+	results []*queryResult
+	next    int
+	full    bool
+}
+
+func (r *ring) add(result *queryResult) {
+	r.results[r.next] = result
+	r.next = (r.next + 1) % len(r.results)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// all returns the stored results, oldest first
+func (r *ring) all() []*queryResult {
+	if !r.full {
+		return append([]*queryResult(nil), r.results[:r.next]...)
+	}
+	return append(append([]*queryResult(nil), r.results[r.next:]...), r.results[:r.next]...)
+}
+
+// historySink keeps recent results of each query in memory and serves them
+//
+//	GET /queries                          the catalog
+//	GET /queries/{key}/latest            most recent result
+//	GET /queries/{key}?from=<ts>&to=<ts> results of windows overlapping [from, to)
+//
+// where key is the query name, followed by its tags for queries run per
+// game, e.g. user_load;game_id=3
+type historySink struct {
+	mu    sync.RWMutex
+	defs  []*queryDef
+	rings map[string]*ring
+}
+
+func newHistorySink(defs []*queryDef, size int) *historySink {
+	if size < 1 {
+		size = 1
+	}
+
+	h := &historySink{defs: defs, rings: make(map[string]*ring)}
+	for _, def := range defs {
+		h.rings[def.key()] = &ring{results: make([]*queryResult, size)}
+	}
+	return h
+}
+
+func (h *historySink) write(result *queryResult) error {
+	if result.err != nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r, ok := h.rings[result.key()]; ok {
+		r.add(result)
+	}
+	return nil
+}
+
+// serve starts the http server in the background
+func (h *historySink) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/queries", h.handleList)
+	mux.HandleFunc("/queries/", h.handleQuery)
+
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+}
+
+func (h *historySink) handleList(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type entry struct {
+		Key     string                 `json:"key"`
+		Name    string                 `json:"name"`
+		Tags    map[string]interface{} `json:"tags,omitempty"`
+		Query   string                 `json:"query"`
+		Columns []string               `json:"columns,omitempty"`
+		Refresh int64                  `json:"refresh"`
+	}
+
+	list := make([]entry, 0, len(h.defs))
+	for _, def := range h.defs {
+		list = append(list, entry{Key: def.key(), Name: def.Name, Tags: def.tags, Query: def.Query, Columns: def.Columns, Refresh: def.interval()})
+	}
+	writeJSON(w, list)
+}
+
+func (h *historySink) handleQuery(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/queries/"), "/"), "/")
+	if len(parts) > 2 || (len(parts) == 2 && parts[1] != "latest") {
+		http.NotFound(w, req)
+		return
+	}
+
+	h.mu.RLock()
+	r, ok := h.rings[parts[0]]
+	var results []*queryResult
+	if ok {
+		results = r.all()
+	}
+	h.mu.RUnlock()
+
+	if !ok {
+		http.Error(w, "unknown query "+parts[0], http.StatusNotFound)
+		return
+	}
+
+	// the scheduler may complete windows out of order while catching up
+	sort.Slice(results, func(i, j int) bool { return results[i].start < results[j].start })
+
+	if len(parts) == 2 {
+		if len(results) == 0 {
+			http.Error(w, "no results yet", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, newResultDoc(results[len(results)-1]))
+		return
+	}
+
+	from, err := queryInt(req, "from", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := queryInt(req, "to", 1<<62)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	docs := make([]*resultDoc, 0)
+	for _, result := range results {
+		if result.end > from && result.start < to {
+			docs = append(docs, newResultDoc(result))
+		}
+	}
+	writeJSON(w, docs)
+}
+
+// queryInt reads a unix timestamp from the query string
+func queryInt(req *http.Request, name string, def int64) (int64, error) {
+	val := req.URL.Query().Get(name)
+	if val == "" {
+		return def, nil
+	}
+	return strconv.ParseInt(val, 10, 64)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Unable to write response, Error %v", err)
+	}
+}
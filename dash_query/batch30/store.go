@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/couchbase/go-couchbase"
+)
+
+var cbServer = flag.String("cbServer", "http://localhost:8091", "couchbase server URL for storing results")
+var cbBucket = flag.String("cbBucket", "", "couchbase bucket to store results in, results are not stored if empty")
+var cbExpiry = flag.Int("cbExpiry", 0, "expiry in seconds of stored results, 0 to keep them forever")
+
+// resultDoc is stored as dash::<queryName>::<windowStart>, with the query
+// name followed by its tags when it runs per game, e.g. user_load;game_id=3
+type resultDoc struct {
+	Name             string                   `json:"name"`
+	Tags             map[string]interface{}   `json:"tags,omitempty"`
+	Query            string                   `json:"query"`
+	WindowStart      int64                    `json:"windowStart"`
+	WindowEnd        int64                    `json:"windowEnd"`
+	ExecutedAt       int64                    `json:"executedAt"`
+	ClientDurationMs int64                    `json:"clientDurationMs"` // measured by batch30, the service times are in Metrics
+	RowCount         int                      `json:"rowCount"`
+	Metrics          *metricsDoc              `json:"metrics"`
+	Rows             []map[string]interface{} `json:"rows"`
+}
+
+// couchbaseSink writes each result to a couchbase bucket so the dashboard
+// can read the history of a query
+type couchbaseSink struct {
+	bucket *couchbase.Bucket
+}
+
+func newCouchbaseSink(server, bucketName string) (*couchbaseSink, error) {
+	c, err := couchbase.Connect(server)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %v: %v", server, err)
+	}
+
+	pool, err := c.GetPool("default")
+	if err != nil {
+		return nil, fmt.Errorf("Error getting pool: %v", err)
+	}
+
+	bucket, err := pool.GetBucket(bucketName)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting bucket %v: %v", bucketName, err)
+	}
+
+	return &couchbaseSink{bucket: bucket}, nil
+}
+
+func resultKey(name string, windowStart int64) string {
+	return fmt.Sprintf("dash::%s::%d", name, windowStart)
+}
+
+func newResultDoc(result *queryResult) *resultDoc {
+	return &resultDoc{
+		Name:             result.name,
+		Tags:             result.tags,
+		Query:            result.query,
+		WindowStart:      result.start,
+		WindowEnd:        result.end,
+		ExecutedAt:       result.executedAt.Unix(),
+		ClientDurationMs: int64(result.duration / time.Millisecond),
+		RowCount:         len(result.rows),
+		Metrics:          newMetricsDoc(result),
+		Rows:             result.rows,
+	}
+}
+
+// write stores the result, replacing any earlier run of the same window.
+// Failed runs are not stored so they never hide an earlier good result.
+func (cs *couchbaseSink) write(result *queryResult) error {
+	if result.err != nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(newResultDoc(result))
+	if err != nil {
+		return err
+	}
+	return cs.bucket.SetRaw(resultKey(result.key(), result.start), *cbExpiry, encoded)
+}
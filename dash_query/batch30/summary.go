@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// summary counts the outcome of every query run
+type summary struct {
+	mu        sync.Mutex
+	succeeded map[string]int
+	failed    map[string]int
+	timedOut  map[string]int
+}
+
+var runSummary = &summary{
+	succeeded: make(map[string]int),
+	failed:    make(map[string]int),
+	timedOut:  make(map[string]int),
+}
+
+func (s *summary) write(result *queryResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case result.err == nil:
+		s.succeeded[result.key()]++
+	case result.err == context.DeadlineExceeded:
+		s.timedOut[result.key()]++
+	default:
+		s.failed[result.key()]++
+	}
+	return nil
+}
+
+// print logs which queries succeeded, failed or timed out
+func (s *summary) print() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Printf("Succeeded: %v", summarize(s.succeeded))
+	log.Printf("Failed: %v", summarize(s.failed))
+	log.Printf("Timed out: %v", summarize(s.timedOut))
+}
+
+// summarize lists query names, with run counts when a query ran more than once
+func summarize(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "none"
+	}
+
+	names := make([]string, 0, len(counts))
+	for name, n := range counts {
+		if n > 1 {
+			name = name + " x" + strconv.Itoa(n)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
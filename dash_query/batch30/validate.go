@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+)
+
+var validate = flag.Bool("validate", false, "EXPLAIN every query on startup and leave out the ones that would scan the primary index")
+var allowPrimaryScan = flag.Bool("allowPrimaryScan", false, "with -validate, run queries using a primary scan anyway")
+
+// plan is what EXPLAIN says about the index use of a query
+type plan struct {
+	operators map[string]bool // e.g. IndexScan3, PrimaryScan, Filter
+	indexes   []string
+}
+
+func (p *plan) primaryScan() bool {
+	return p.operators["PrimaryScan"] || p.operators["PrimaryScan3"]
+}
+
+// validateQueries explains each query and returns the ones allowed to run.
+// Copies of a query made for each game share its plan and are explained once.
+func validateQueries(client *n1ql.Client, defs []*queryDef) []*queryDef {
+	plans := make(map[string]*plan)
+	refused := make(map[string]bool)
+
+	now := time.Now().Unix()
+	for _, def := range defs {
+		if _, ok := plans[def.Name]; ok {
+			continue
+		}
+
+		p, err := explain(client, def, now-def.interval(), now)
+		if err != nil {
+			// a query that can't be planned fails the same way when run
+			log.Printf("Unable to explain query %v, Error %v", def.Name, err)
+			refused[def.Name] = true
+			plans[def.Name] = nil
+			continue
+		}
+		plans[def.Name] = p
+
+		switch {
+		case !p.primaryScan():
+			log.Printf("Query %v uses index %v", def.Name, strings.Join(p.indexes, ", "))
+		case *allowPrimaryScan || def.AllowPrimaryScan:
+			log.Printf("Query %v scans the primary index, allowed", def.Name)
+		default:
+			log.Printf("Query %v scans the primary index, not running it. Add an index on the fields it filters on, or set allowPrimaryScan", def.Name)
+			refused[def.Name] = true
+		}
+	}
+
+	allowed := make([]*queryDef, 0, len(defs))
+	for _, def := range defs {
+		if !refused[def.Name] {
+			allowed = append(allowed, def)
+		}
+	}
+	return allowed
+}
+
+// explain runs EXPLAIN on the query bound to the window
+func explain(client *n1ql.Client, def *queryDef, start, end int64) (*plan, error) {
+	args, err := def.bind(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), def.timeout())
+	defer cancel()
+
+	_, rows, err := client.Query(ctx, "EXPLAIN "+def.text, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{operators: make(map[string]bool)}
+	indexes := make(map[string]bool)
+	for _, row := range rows {
+		for _, v := range row {
+			walkPlan(v, p.operators, indexes)
+		}
+	}
+
+	for index := range indexes {
+		p.indexes = append(p.indexes, index)
+	}
+	sort.Strings(p.indexes)
+	return p, nil
+}
+
+// walkPlan collects the #operator of every step of a plan and the indexes
+// the scans use
+func walkPlan(v interface{}, operators, indexes map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if op, ok := v["#operator"].(string); ok {
+			operators[op] = true
+			if index, ok := v["index"].(string); ok && strings.Contains(op, "Scan") {
+				indexes[index] = true
+			}
+		}
+		for _, child := range v {
+			walkPlan(child, operators, indexes)
+		}
+	case []interface{}:
+		for _, child := range v {
+			walkPlan(child, operators, indexes)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/moonfrog/cbutils/internal/n1ql"
+)
+
+var groupBy = flag.String("groupBy", "", "with -type=generic, comma separated columns to group rows by, e.g. metric,subtype")
+var valuePath = flag.String("value", "", "with -type=generic, column holding the value, or a dotted path into a JSON column, e.g. duration.ms")
+
+// aggregation says how rows are turned into samples: which columns group
+// them and where the value of each row is
+type aggregation struct {
+	dims  []string
+	value []string // column followed by the path inside it
+}
+
+// newAggregation returns the aggregation of a -type. debug and player are
+// the layouts of the queries in query_file.txt and player_load.txt.
+func newAggregation(queryType, groupBy, value string) (*aggregation, error) {
+	switch queryType {
+	case "debug":
+		groupBy, value = "metric,subtype", "timeMsec"
+	case "player":
+		groupBy, value = "", "duration"
+	case "generic":
+		if value == "" {
+			return nil, fmt.Errorf("-type=generic needs -value")
+		}
+	default:
+		return nil, fmt.Errorf("unknown query type %v, expected debug, player or generic", queryType)
+	}
+
+	agg := &aggregation{value: strings.Split(value, ".")}
+	for _, dim := range strings.Split(groupBy, ",") {
+		if dim = strings.TrimSpace(dim); dim != "" {
+			agg.dims = append(agg.dims, dim)
+		}
+	}
+	return agg, nil
+}
+
+// valueOf returns the value of a row. The driver may hand back a selected
+// field as the whole object holding it, e.g. {"duration": 12}, so an object
+// with a key named like the last step of the path is unwrapped.
+func (agg *aggregation) valueOf(row map[string]interface{}) (float64, bool) {
+	v := row[agg.value[0]]
+	for _, key := range agg.value[1:] {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		v = obj[key]
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok {
+		v = obj[agg.value[len(agg.value)-1]]
+	}
+	return n1ql.Float(v)
+}
+
+// sample collects the values of one group
+type sample interface {
+	add(x float64)
+	stats() map[string]interface{}
+}
+
+// exactSample keeps every value, its statistics are exact
+type exactSample struct {
+	numbers []float64
+}
+
+func (e *exactSample) add(x float64) {
+	e.numbers = append(e.numbers, x)
+}
+
+func (e *exactSample) stats() map[string]interface{} {
+	return describe(e.numbers)
+}
+
+// grouping collects the rows of a query into one sample per group
+type grouping struct {
+	agg       *aggregation
+	newSample func() sample
+	samples   map[string]sample
+	groups    map[string][]string // key -> dimension values
+}
+
+func (agg *aggregation) newGrouping(newSample func() sample) *grouping {
+	return &grouping{
+		agg:       agg,
+		newSample: newSample,
+		samples:   make(map[string]sample),
+		groups:    make(map[string][]string),
+	}
+}
+
+// add counts a row in its group, rows can come in any order
+func (g *grouping) add(row map[string]interface{}) error {
+	val, ok := g.agg.valueOf(row)
+	if !ok {
+		log.Printf(" Skipping row without a numeric %v %v", strings.Join(g.agg.value, "."), row)
+		return nil
+	}
+
+	group := make([]string, len(g.agg.dims))
+	for i, dim := range g.agg.dims {
+		group[i] = dimensionKey(row[dim])
+	}
+	g.sample(group).add(val)
+	return nil
+}
+
+// sample returns the sample of a group, creating it on first use
+func (g *grouping) sample(group []string) sample {
+	key := strings.Join(group, "\x00")
+	s, ok := g.samples[key]
+	if !ok {
+		s = g.newSample()
+		g.samples[key] = s
+		g.groups[key] = group
+	}
+	return s
+}
+
+// result returns the statistics of each group nested one level per
+// dimension, e.g. metric -> subtype -> statistics, or just the statistics
+// when there are no dimensions
+func (g *grouping) result() map[string]interface{} {
+	if len(g.agg.dims) == 0 {
+		if s, ok := g.samples[""]; ok {
+			return s.stats()
+		}
+		return g.newSample().stats()
+	}
+
+	nested := make(map[string]interface{})
+	for key, group := range g.groups {
+		level := nested
+		for _, v := range group[:len(group)-1] {
+			next, ok := level[v].(map[string]interface{})
+			if !ok {
+				next = make(map[string]interface{})
+				level[v] = next
+			}
+			level = next
+		}
+		level[group[len(group)-1]] = g.samples[key].stats()
+	}
+	return nested
+}
+
+// aggregate groups rows already read and calculates exact statistics
+func (agg *aggregation) aggregate(results []map[string]interface{}) map[string]interface{} {
+	g := agg.newGrouping(func() sample { return &exactSample{} })
+	for _, row := range results {
+		g.add(row)
+	}
+	return g.result()
+}
+
+// dimensionKey formats a dimension value as text. Whole numbers are written
+// as decimal digits whether they were stored as numbers or strings, so 1,
+// 1.0 and "1" share a group.
+func dimensionKey(v interface{}) string {
+	if f, ok := n1ql.Float(v); ok && f == math.Trunc(f) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return n1ql.String(v)
+}
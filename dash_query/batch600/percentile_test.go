@@ -0,0 +1,186 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// rows shaped like the output of query_file.txt: metric, subtype, timeMsec
+func debugRow(metric string, subtype interface{}, timeMsec interface{}) map[string]interface{} {
+	return map[string]interface{}{"metric": metric, "subtype": subtype, "timeMsec": timeMsec}
+}
+
+func TestDebugGroupBy(t *testing.T) {
+	percentiles = []float64{50, 90}
+
+	tests := []struct {
+		name string
+		rows []map[string]interface{}
+		want map[string]map[string]int // metric -> subtype -> count
+	}{
+		{
+			name: "ordered",
+			rows: []map[string]interface{}{
+				debugRow("join_ack_time", int64(1), int64(10)),
+				debugRow("join_ack_time", int64(1), int64(20)),
+				debugRow("join_ack_time", int64(2), int64(30)),
+				debugRow("ws_create_time", int64(1), int64(40)),
+			},
+			want: map[string]map[string]int{
+				"join_ack_time":  {"1": 2, "2": 1},
+				"ws_create_time": {"1": 1},
+			},
+		},
+		{
+			name: "unordered",
+			rows: []map[string]interface{}{
+				debugRow("ws_create_time", int64(3), int64(5)),
+				debugRow("join_ack_time", int64(2), int64(30)),
+				debugRow("ws_create_time", int64(1), int64(40)),
+				debugRow("join_ack_time", int64(1), int64(10)),
+				debugRow("join_ack_time", int64(2), int64(35)),
+			},
+			want: map[string]map[string]int{
+				"join_ack_time":  {"1": 1, "2": 2},
+				"ws_create_time": {"1": 1, "3": 1},
+			},
+		},
+		{
+			name: "string and numeric subtypes",
+			rows: []map[string]interface{}{
+				debugRow("chaal_time_new", "1", int64(10)),
+				debugRow("chaal_time_new", int64(1), "20"),
+				debugRow("chaal_time_new", float64(1), 30.5),
+				debugRow("chaal_time_new", "2", int64(40)),
+			},
+			want: map[string]map[string]int{
+				"chaal_time_new": {"1": 3, "2": 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agg, err := newAggregation("debug", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := agg.aggregate(tt.rows)
+
+			total := 0
+			for metric, subTypes := range got {
+				if _, ok := tt.want[metric]; !ok {
+					t.Errorf("unexpected metric %q", metric)
+					continue
+				}
+				for subType, stats := range subTypes.(map[string]interface{}) {
+					if subType == "\x01" || subType == "\x02" || subType == "\x03" {
+						t.Errorf("%v: subtype keyed as a control character %q", metric, subType)
+					}
+					count := stats.(map[string]interface{})["count"].(int)
+					if want := tt.want[metric][subType]; count != want {
+						t.Errorf("%v/%v: count %v, want %v", metric, subType, count, want)
+					}
+					total += count
+				}
+			}
+
+			for metric, subTypes := range tt.want {
+				for subType := range subTypes {
+					m, _ := got[metric].(map[string]interface{})
+					if _, ok := m[subType]; !ok {
+						t.Errorf("%v/%v missing from result", metric, subType)
+					}
+				}
+			}
+
+			if total != len(tt.rows) {
+				t.Errorf("%v samples counted, want %v", total, len(tt.rows))
+			}
+		})
+	}
+}
+
+func TestDebugStats(t *testing.T) {
+	percentiles = []float64{50, 90}
+
+	agg, err := newAggregation("debug", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := agg.aggregate([]map[string]interface{}{
+		debugRow("player_load", int64(1), int64(30)),
+		debugRow("player_load", int64(1), int64(10)),
+		debugRow("player_load", int64(1), int64(20)),
+	})
+
+	stats := got["player_load"].(map[string]interface{})["1"].(map[string]interface{})
+	want := map[string]interface{}{
+		"count":           3,
+		"min":             10.0,
+		"max":             30.0,
+		"mean":            20.0,
+		"50th percentile": 20.0,
+		"90th percentile": 30.0,
+	}
+	for key, w := range want {
+		if stats[key] != w {
+			t.Errorf("%v = %v, want %v", key, stats[key], w)
+		}
+	}
+}
+
+func TestRankOf(t *testing.T) {
+	tests := []struct {
+		p    float64
+		n    int
+		want int
+	}{
+		{99.9, 1000, 999},
+		{64.4, 1000, 644}, // 64.4*1000/100 is 644.0000000000001 in floating point
+		{50, 4, 2},
+		{50, 5, 3},
+		{100, 7, 7},
+		{1, 1, 1},
+		{0.001, 10, 1},
+	}
+
+	for _, tt := range tests {
+		if got := rankOf(tt.p, tt.n); got != tt.want {
+			t.Errorf("rankOf(%v, %v) = %v, want %v", tt.p, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	thousand := make([]float64, 1000)
+	for i := range thousand {
+		thousand[i] = float64(i + 1)
+	}
+
+	tests := []struct {
+		name   string
+		sorted []float64
+		p      float64
+		method string
+		want   float64
+	}{
+		{"nearest 99.9 of 1000", thousand, 99.9, nearestRank, 999},
+		{"nearest 64.4 of 1000", thousand, 64.4, nearestRank, 644},
+		{"nearest single value", []float64{42}, 50, nearestRank, 42},
+		{"linear single value", []float64{42}, 50, linear, 42},
+		{"nearest median", []float64{1, 2, 3, 4}, 50, nearestRank, 2},
+		{"linear median", []float64{1, 2, 3, 4}, 50, linear, 2.5},
+		{"linear 90", []float64{1, 2, 3, 4}, 90, linear, 3.7},
+		{"nearest 100", []float64{1, 2, 3, 4}, 100, nearestRank, 4},
+		{"linear 100", []float64{1, 2, 3, 4}, 100, linear, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := percentile(tt.sorted, tt.p, tt.method); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("percentile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
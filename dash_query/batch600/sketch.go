@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var useSketch = flag.Bool("sketch", false, "compute quantiles with a DDSketch while streaming rows instead of loading every value")
+var accuracy = flag.Float64("accuracy", 0.01, "with -sketch, relative accuracy of the quantiles, e.g. 0.01 for within 1%")
+var maxBins = flag.Int("maxBins", 2048, "with -sketch, most bins kept per sign, the lowest quantiles lose accuracy first when exceeded")
+var sketchDir = flag.String("sketchDir", "", "with -sketch, directory to save the sketches of each query window in for merging later")
+var mergeFiles = flag.String("merge", "", "comma separated sketch files to merge and report on instead of running queries")
+
+// sketch is a DDSketch. Every value x > 0 is counted in bin
+// ceil(log(x) / log(gamma)), gamma = (1 + accuracy) / (1 - accuracy), so
+// any quantile is returned within accuracy of the true value while memory
+// only grows with the log of the range of values. Sketches built with the
+// same accuracy merge exactly, so windows can be combined later.
+//
+// count, sum, sum of squares, min and max are tracked exactly.
+type sketch struct {
+	Accuracy float64        `json:"accuracy"`
+	MaxBins  int            `json:"maxBins"`
+	Count    uint64         `json:"count"`
+	Zero     uint64         `json:"zero"`
+	Positive map[int]uint64 `json:"positive"`
+	Negative map[int]uint64 `json:"negative"` // bins of -x
+	Sum      float64        `json:"sum"`
+	SumSq    float64        `json:"sumSq"`
+	Min      float64        `json:"min"`
+	Max      float64        `json:"max"`
+
+	gamma float64
+}
+
+func newSketch(accuracy float64, maxBins int) (*sketch, error) {
+	if accuracy <= 0 || accuracy >= 1 {
+		return nil, fmt.Errorf("invalid accuracy %v, expected a number in (0, 1)", accuracy)
+	}
+	if maxBins < 1 {
+		return nil, fmt.Errorf("invalid maxBins %v", maxBins)
+	}
+	s := &sketch{
+		Accuracy: accuracy,
+		MaxBins:  maxBins,
+		Positive: make(map[int]uint64),
+		Negative: make(map[int]uint64),
+	}
+	s.init()
+	return s, nil
+}
+
+func (s *sketch) init() {
+	s.gamma = (1 + s.Accuracy) / (1 - s.Accuracy)
+}
+
+func (s *sketch) index(x float64) int {
+	return int(math.Ceil(math.Log(x) / math.Log(s.gamma)))
+}
+
+// value is the estimate returned for every value counted in bin i
+func (s *sketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+func (s *sketch) add(x float64) {
+	switch {
+	case x > 0:
+		s.Positive[s.index(x)]++
+		collapse(s.Positive, s.MaxBins, false)
+	case x < 0:
+		s.Negative[s.index(-x)]++
+		collapse(s.Negative, s.MaxBins, true)
+	default:
+		s.Zero++
+	}
+
+	if s.Count == 0 || x < s.Min {
+		s.Min = x
+	}
+	if s.Count == 0 || x > s.Max {
+		s.Max = x
+	}
+	s.Count++
+	s.Sum += x
+	s.SumSq += x * x
+}
+
+// collapse folds bins into their neighbour until at most max are left,
+// giving up accuracy at the values closest to zero for positive bins and
+// furthest from zero for negative ones, i.e. at the low quantiles
+func collapse(bins map[int]uint64, max int, negative bool) {
+	if len(bins) <= max {
+		return
+	}
+	keys := make([]int, 0, len(bins))
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	if negative {
+		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+	}
+
+	for len(bins) > max {
+		bins[keys[1]] += bins[keys[0]]
+		delete(bins, keys[0])
+		keys = keys[1:]
+	}
+}
+
+// merge adds the values counted by o
+func (s *sketch) merge(o *sketch) error {
+	if o.Accuracy != s.Accuracy {
+		return fmt.Errorf("can't merge sketches of accuracy %v and %v", s.Accuracy, o.Accuracy)
+	}
+	if o.Count == 0 {
+		return nil
+	}
+
+	for k, n := range o.Positive {
+		s.Positive[k] += n
+	}
+	for k, n := range o.Negative {
+		s.Negative[k] += n
+	}
+	collapse(s.Positive, s.MaxBins, false)
+	collapse(s.Negative, s.MaxBins, true)
+
+	if s.Count == 0 || o.Min < s.Min {
+		s.Min = o.Min
+	}
+	if s.Count == 0 || o.Max > s.Max {
+		s.Max = o.Max
+	}
+	s.Count += o.Count
+	s.Zero += o.Zero
+	s.Sum += o.Sum
+	s.SumSq += o.SumSq
+	return nil
+}
+
+// quantile returns the value at quantile q in [0, 1], s must not be empty.
+// It uses the same nearest rank as describe, so -sketch and exact runs
+// pick the same value up to the sketch accuracy.
+func (s *sketch) quantile(q float64) float64 {
+	rank := uint64(rankOf(q*100, int(s.Count)) - 1)
+
+	var n uint64
+	negative := make([]int, 0, len(s.Negative))
+	for k := range s.Negative {
+		negative = append(negative, k)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(negative)))
+	for _, k := range negative {
+		if n += s.Negative[k]; n > rank {
+			return s.clamp(-s.value(k))
+		}
+	}
+
+	if n += s.Zero; n > rank {
+		return 0
+	}
+
+	positive := make([]int, 0, len(s.Positive))
+	for k := range s.Positive {
+		positive = append(positive, k)
+	}
+	sort.Ints(positive)
+	for _, k := range positive {
+		if n += s.Positive[k]; n > rank {
+			return s.clamp(s.value(k))
+		}
+	}
+	return s.Max
+}
+
+// clamp keeps estimates within the exact min and max
+func (s *sketch) clamp(v float64) float64 {
+	return math.Max(s.Min, math.Min(s.Max, v))
+}
+
+// stats returns the same statistics as describe
+func (s *sketch) stats() map[string]interface{} {
+	stats := make(map[string]interface{})
+	stats["count"] = int(s.Count)
+	if s.Count == 0 {
+		return stats
+	}
+
+	mean := s.Sum / float64(s.Count)
+	stats["min"] = s.Min
+	stats["max"] = s.Max
+	stats["mean"] = mean
+	stats["stddev"] = math.Sqrt(math.Max(0, s.SumSq/float64(s.Count)-mean*mean))
+
+	for _, p := range percentiles {
+		stats[percentileName(p)] = s.quantile(p / 100)
+	}
+	return stats
+}
+
+// sketchGroup is the sketch of one group in a sketch file
+type sketchGroup struct {
+	Dims   map[string]string `json:"dims"`
+	Sketch *sketch           `json:"sketch"`
+}
+
+// sketchFile holds the sketches of one query window, written with
+// -sketchDir and read back with -merge
+type sketchFile struct {
+	Query       string         `json:"query"`
+	WindowStart int64          `json:"windowStart"`
+	WindowEnd   int64          `json:"windowEnd"`
+	GroupBy     []string       `json:"groupBy"`
+	Groups      []*sketchGroup `json:"groups"`
+}
+
+func readSketchFile(path string) (*sketchFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sf sketchFile
+	if err = json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", path, err)
+	}
+	for _, g := range sf.Groups {
+		if g.Sketch == nil {
+			return nil, fmt.Errorf("%v: group %v has no sketch", path, g.Dims)
+		}
+		if g.Sketch.Positive == nil {
+			g.Sketch.Positive = make(map[int]uint64)
+		}
+		if g.Sketch.Negative == nil {
+			g.Sketch.Negative = make(map[int]uint64)
+		}
+		g.Sketch.init()
+	}
+	return &sf, nil
+}
+
+// writeSketches saves the sketches of a query window as
+// <sketchDir>/query<n>.<windowStart>.json
+func writeSketches(g *grouping, n int, query string, start, end int64) error {
+	sf := &sketchFile{
+		Query:       query,
+		WindowStart: start,
+		WindowEnd:   end,
+		GroupBy:     g.agg.dims,
+		Groups:      make([]*sketchGroup, 0, len(g.samples)),
+	}
+	for key, group := range g.groups {
+		dims := make(map[string]string, len(group))
+		for i, dim := range g.agg.dims {
+			dims[dim] = group[i]
+		}
+		sf.Groups = append(sf.Groups, &sketchGroup{Dims: dims, Sketch: g.samples[key].(*sketch)})
+	}
+
+	data, err := json.Marshal(sf)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(*sketchDir, fmt.Sprintf("query%d.%d.json", n, start))
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// mergeSketches merges the sketch files of windows of the same query and
+// returns the statistics of the combined windows
+func mergeSketches(paths []string) (map[string]interface{}, error) {
+	var g *grouping
+	var groupBy, query string
+
+	// new groups take the accuracy of the first sketch read
+	acc, bins := *accuracy, *maxBins
+
+	for _, path := range paths {
+		sf, err := readSketchFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+
+		if g == nil {
+			query = sf.Query
+			groupBy = strings.Join(sf.GroupBy, ",")
+			g = (&aggregation{dims: sf.GroupBy}).newGrouping(func() sample {
+				s, _ := newSketch(acc, bins)
+				return s
+			})
+		} else if sf.Query != query {
+			return nil, fmt.Errorf("%v is a sketch of a different query", path)
+		} else if strings.Join(sf.GroupBy, ",") != groupBy {
+			return nil, fmt.Errorf("%v is grouped by %v, not %v", path, sf.GroupBy, groupBy)
+		}
+
+		for _, sg := range sf.Groups {
+			if len(g.samples) == 0 {
+				acc, bins = sg.Sketch.Accuracy, sg.Sketch.MaxBins
+			} else if sg.Sketch.Accuracy != acc {
+				return nil, fmt.Errorf("%v: group %v has accuracy %v, not %v", path, sg.Dims, sg.Sketch.Accuracy, acc)
+			}
+			group := make([]string, len(sf.GroupBy))
+			for i, dim := range sf.GroupBy {
+				group[i] = sg.Dims[dim]
+			}
+			if err = g.sample(group).(*sketch).merge(sg.Sketch); err != nil {
+				return nil, fmt.Errorf("%v: %v", path, err)
+			}
+		}
+	}
+
+	if g == nil {
+		return nil, fmt.Errorf("no sketch files to merge")
+	}
+	return g.result(), nil
+}
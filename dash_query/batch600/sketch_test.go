@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// sketchWindow adds rows to sketches of the given accuracy the way -sketch does
+func sketchWindow(t *testing.T, agg *aggregation, rows []map[string]interface{}, acc float64) *grouping {
+	g := agg.newGrouping(func() sample {
+		s, err := newSketch(acc, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+	for _, row := range rows {
+		if err := g.add(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return g
+}
+
+// latencyRows returns n rows per game with log-normally distributed values
+func latencyRows(r *rand.Rand, n int) []map[string]interface{} {
+	rows := make([]map[string]interface{}, 0, 2*n)
+	for i := 0; i < n; i++ {
+		for _, game := range []string{"3", "5"} {
+			rows = append(rows, map[string]interface{}{"game_id": game, "duration": math.Exp(r.NormFloat64()*1.5 + 5)})
+		}
+	}
+	return rows
+}
+
+func TestSketchMerge(t *testing.T) {
+	percentiles = []float64{1, 25, 50, 90, 99, 99.9}
+	*sketchDir = t.TempDir()
+	const acc = 0.01
+
+	agg, err := newAggregation("generic", "game_id", "duration")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	first, second := latencyRows(r, 3000), latencyRows(r, 5000)
+
+	if err = writeSketches(sketchWindow(t, agg, first, acc), 1, "select ...", 1000, 1600); err != nil {
+		t.Fatal(err)
+	}
+	if err = writeSketches(sketchWindow(t, agg, second, acc), 1, "select ...", 1600, 2200); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := mergeSketches([]string{
+		filepath.Join(*sketchDir, "query1.1000.json"),
+		filepath.Join(*sketchDir, "query1.1600.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := agg.aggregate(append(first, second...))
+
+	for _, game := range []string{"3", "5"} {
+		g := got[game].(map[string]interface{})
+		w := want[game].(map[string]interface{})
+
+		for _, key := range []string{"count", "min", "max"} {
+			if g[key] != w[key] {
+				t.Errorf("game %v %v = %v, want %v", game, key, g[key], w[key])
+			}
+		}
+		if math.Abs(g["mean"].(float64)-w["mean"].(float64)) > 1e-6*w["mean"].(float64) {
+			t.Errorf("game %v mean = %v, want %v", game, g["mean"], w["mean"])
+		}
+		for _, p := range percentiles {
+			name := percentileName(p)
+			gv, wv := g[name].(float64), w[name].(float64)
+			if math.Abs(gv-wv) > acc*wv {
+				t.Errorf("game %v %v = %v, want %v within %v", game, name, gv, wv, acc)
+			}
+		}
+	}
+}
+
+func TestSketchMergeMismatch(t *testing.T) {
+	percentiles = []float64{50}
+	*sketchDir = t.TempDir()
+
+	agg, err := newAggregation("generic", "game_id", "duration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := latencyRows(rand.New(rand.NewSource(2)), 100)
+
+	tests := []struct {
+		name  string
+		query string
+		acc   float64
+	}{
+		{"accuracy", "select ...", 0.02},
+		{"query", "select other ...", 0.01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := writeSketches(sketchWindow(t, agg, rows, 0.01), 1, "select ...", 1000, 1600); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeSketches(sketchWindow(t, agg, rows, tt.acc), 1, tt.query, 1600, 2200); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := mergeSketches([]string{
+				filepath.Join(*sketchDir, "query1.1000.json"),
+				filepath.Join(*sketchDir, "query1.1600.json"),
+			})
+			if err == nil {
+				t.Errorf("merging sketches with a different %v succeeded", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// percentile methods
+const (
+	nearestRank = "nearest"
+	linear      = "linear"
+)
+
+// parsePercentiles parses a comma separated list such as 50,90,99.9
+func parsePercentiles(list string) ([]float64, error) {
+	ps := make([]float64, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(s, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("invalid percentile %q, expected a number in (0, 100]", s)
+		}
+		ps = append(ps, p)
+	}
+	if len(ps) == 0 {
+		return nil, fmt.Errorf("no percentiles in %q", list)
+	}
+	return ps, nil
+}
+
+// percentile returns the pth percentile of sorted numbers, which must not
+// be empty. nearest picks the smallest value with at least p percent of
+// the numbers at or below it, linear interpolates between the two closest
+// ranks.
+func percentile(sorted []float64, p float64, method string) float64 {
+	n := len(sorted)
+	if method == linear {
+		h := float64(n-1) * p / 100
+		lo := int(math.Floor(h))
+		if lo >= n-1 {
+			return sorted[n-1]
+		}
+		return sorted[lo] + (h-float64(lo))*(sorted[lo+1]-sorted[lo])
+	}
+
+	return sorted[rankOf(p, n)-1]
+}
+
+// rankOf is the 1-based nearest rank of the pth percentile of n values. The
+// epsilon keeps rounding error in p*n from bumping an exact rank up one,
+// e.g. 64.4 of 1000 is rank 644, not 645.
+func rankOf(p float64, n int) int {
+	rank := int(math.Ceil(p*float64(n)/100 - 1e-9))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > n {
+		rank = n
+	}
+	return rank
+}
+
+// percentileName is the result key of a percentile, e.g. "99.9th percentile"
+func percentileName(p float64) string {
+	return strconv.FormatFloat(p, 'f', -1, 64) + "th percentile"
+}
+
+// describe returns the count, min, max, mean, standard deviation and the
+// -percentiles of numbers. Only the count is given for an empty sample.
+func describe(numbers []float64) map[string]interface{} {
+	stats := make(map[string]interface{})
+	stats["count"] = len(numbers)
+	if len(numbers) == 0 {
+		return stats
+	}
+
+	sorted := append([]float64(nil), numbers...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, v := range sorted {
+		sum += v
+	}
+	mean := sum / float64(len(sorted))
+
+	sq := 0.0
+	for _, v := range sorted {
+		sq += (v - mean) * (v - mean)
+	}
+
+	stats["min"] = sorted[0]
+	stats["max"] = sorted[len(sorted)-1]
+	stats["mean"] = mean
+	stats["stddev"] = math.Sqrt(sq / float64(len(sorted)))
+
+	for _, p := range percentiles {
+		stats[percentileName(p)] = percentile(sorted, p, *percentileMethod)
+	}
+	return stats
+}
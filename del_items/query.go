@@ -3,19 +3,19 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"flag"
-	_ "github.com/couchbase/go_n1ql"
-	"os"
 	"runtime"
 	"sync"
 	"time"
 
 	log "github.com/moonfrog/badger/logger"
+	"github.com/moonfrog/cbutils/internal/n1ql"
 )
 
 var serverURL = flag.String("server", "http://localhost:8093",
 	"couchbase server URL")
+var creds = n1ql.CredentialFlags()
 var diff = flag.Int("diff", 10, "time in minutes")
 var bucket = flag.String("bucket", "stats", "bucket to operate on")
 
@@ -34,13 +34,27 @@ func main() {
 	runtime.GOMAXPROCS(2)
 	doneChan := make(chan bool)
 
+	credList, err := creds.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := n1ql.Open(n1ql.Config{
+		Server:  *serverURL,
+		Timeout: 1000 * time.Second,
+		Creds:   credList,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *bucket == "stats" || *bucket == "all" {
-		go runQuery(statsQuery, doneChan)
+		go runQuery(client, statsQuery, doneChan)
 		wg.Add(1)
 	}
 
 	if *bucket == "economy" || *bucket == "all" {
-		go runQuery(economyQuery, doneChan)
+		go runQuery(client, economyQuery, doneChan)
 		wg.Add(1)
 	}
 
@@ -50,7 +64,7 @@ func main() {
 // run in a loop. Wake up every minute and delete a minute's
 // worth of diff minutes old data
 
-func runQuery(query string, doneChan chan bool) {
+func runQuery(client *n1ql.Client, query string, doneChan chan bool) {
 	defer wg.Done()
 
 	log.Info("Starting query thread")
@@ -59,7 +73,7 @@ func runQuery(query string, doneChan chan bool) {
 
 		select {
 		case <-time.After(time.Minute * 1):
-			go executeQuery(query)
+			go executeQuery(client, query)
 		case <-doneChan:
 			return
 		}
@@ -67,22 +81,7 @@ func runQuery(query string, doneChan chan bool) {
 
 }
 
-func executeQuery(query string) {
-
-	n1ql, err := sql.Open("n1ql", *serverURL)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = n1ql.Ping()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Set query parameters
-	os.Setenv("n1ql_timeout", "1000s")
-	ac := []byte(`[{"user": "admin:Administrator", "pass": "asdasd"}]`)
-	os.Setenv("n1ql_creds", string(ac))
+func executeQuery(client *n1ql.Client, query string) {
 
 	// differnce between start time and end time is 1 minute
 	endTime := time.Now().Unix() - int64((*diff)*60)
@@ -90,18 +89,13 @@ func executeQuery(query string) {
 
 	log.Info("Executing query %v %v %v", query, startTime, endTime)
 
-	result, err := n1ql.Exec(query, startTime, endTime)
+	rowsAffected, err := client.Exec(context.Background(), query, startTime, endTime)
 
 	queryTime := time.Now().Unix() - (endTime + (int64(*diff) * 60))
 
 	if err != nil {
 		log.Error(" Failed to execute query. Error %v", err)
 	} else {
-
-		rowsAffected, err := result.RowsAffected()
-		if err != nil {
-			log.Fatal(err)
-		}
 		log.Info("Rows Deleted %d queryTime %v", rowsAffected, queryTime)
 	}
 
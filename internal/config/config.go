@@ -0,0 +1,244 @@
+// Package config loads command configuration from several layers so the
+// tools can run without a ZooKeeper ensemble. Each struct registered with
+// Add is filled from, lowest precedence first:
+//
+//	ZooKeeper (when -zookeeper is set), e.g. config/couchbase
+//	the -config YAML or JSON file, section "couchbase"
+//	environment variables, e.g. CBUTILS_COUCHBASE_SERVERURL
+//	flags, e.g. -couchbase.serverURL
+//
+// The section name is the last element of the ZooKeeper path. Only string,
+// numeric and bool fields can be set from the environment and flags; other
+// fields come from the file or ZooKeeper. ZooKeeper is only read with
+// -zookeeper.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/moonfrog/badger/zootils"
+	"gopkg.in/yaml.v2"
+)
+
+const envPrefix = "CBUTILS"
+
+type section struct {
+	name   string
+	zkPath string
+	value  interface{}
+	flags  map[string]*string // flag name -> value
+	fields map[string]string  // flag name -> struct field
+
+	optional bool // a failed zookeeper load is ignored
+}
+
+// Loader fills registered config structs once flags have been parsed
+type Loader struct {
+	file      *string
+	zookeeper *bool
+	sections  []*section
+}
+
+// New registers the -config and -zookeeper flags on the default flag set
+func New() *Loader {
+	return &Loader{
+		file:      flag.String("config", "", "YAML or JSON config file"),
+		zookeeper: flag.Bool("zookeeper", false, "load config from zookeeper before the file, env and flags"),
+	}
+}
+
+// Add registers v, a pointer to a struct, under the given zookeeper path and
+// defines a flag for each of its scalar fields. Call it before flag.Parse.
+func (l *Loader) Add(zkPath string, v interface{}) {
+	s := &section{
+		name:   path.Base(zkPath),
+		zkPath: zkPath,
+		value:  v,
+		flags:  make(map[string]*string),
+		fields: make(map[string]string),
+	}
+
+	t := reflect.TypeOf(v).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || !scalar(f.Type.Kind()) {
+			continue
+		}
+		name := s.name + "." + lowerFirst(f.Name)
+		s.flags[name] = flag.String(name, "", fmt.Sprintf("%s %s", s.name, f.Name))
+		s.fields[name] = f.Name
+	}
+
+	l.sections = append(l.sections, s)
+}
+
+// AddOptional is Add for a section whose zookeeper path may be missing or
+// unreadable, the other layers can still fill it
+func (l *Loader) AddOptional(zkPath string, v interface{}) {
+	l.Add(zkPath, v)
+	l.sections[len(l.sections)-1].optional = true
+}
+
+// Load fills every registered struct. Call it after flag.Parse.
+func (l *Loader) Load() error {
+	var file map[string]interface{}
+	if *l.file != "" {
+		var err error
+		file, err = readFile(*l.file)
+		if err != nil {
+			return err
+		}
+	}
+
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	for _, s := range l.sections {
+		if *l.zookeeper {
+			err := zootils.GetInstance().LoadConfig(s.value, s.zkPath, func(string) {})
+			if err != nil && !s.optional {
+				return fmt.Errorf("zookeeper %v: %v", s.zkPath, err)
+			}
+		}
+
+		if raw, ok := file[s.name]; ok {
+			// round trip through json so field names match case-insensitively
+			// the same way they do for zookeeper
+			encoded, err := json.Marshal(raw)
+			if err != nil {
+				return fmt.Errorf("%v section %v: %v", *l.file, s.name, err)
+			}
+			if err = json.Unmarshal(encoded, s.value); err != nil {
+				return fmt.Errorf("%v section %v: %v", *l.file, s.name, err)
+			}
+		}
+
+		elem := reflect.ValueOf(s.value).Elem()
+		for name, field := range s.fields {
+			env := strings.ToUpper(envPrefix + "_" + s.name + "_" + field)
+			if val, ok := os.LookupEnv(env); ok {
+				if err := setField(elem.FieldByName(field), val); err != nil {
+					return fmt.Errorf("%v: %v", env, err)
+				}
+			}
+			if set[name] {
+				if err := setField(elem.FieldByName(field), *s.flags[name]); err != nil {
+					return fmt.Errorf("-%v: %v", name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// readFile parses a YAML or JSON config file into its top level sections
+func readFile(name string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unknown config file type %v", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %v: %v", name, err)
+	}
+
+	sections, ok := normalize(raw).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: top level must be a map of sections", name)
+	}
+	return sections, nil
+}
+
+// normalize converts the map[interface{}]interface{} values produced by the
+// yaml parser into something encoding/json can marshal
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalize(val)
+		}
+		return m
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = normalize(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = normalize(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+func scalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func setField(f reflect.Value, val string) error {
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(val)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(val, 10, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(val, f.Type().Bits())
+		if err != nil {
+			return err
+		}
+		f.SetFloat(n)
+	}
+	return nil
+}
+
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}
@@ -0,0 +1,141 @@
+package n1ql
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/moonfrog/badger/zootils"
+	"gopkg.in/yaml.v2"
+)
+
+// Credential is one entry of the n1ql_creds list. User is an RBAC user name,
+// "admin:<name>" for the cluster administrator, or set Bucket instead to
+// use the password of a bucket, which becomes user "local:<bucket>".
+type Credential struct {
+	User   string `json:"user" yaml:"user"`
+	Pass   string `json:"pass" yaml:"pass"`
+	Bucket string `json:"bucket,omitempty" yaml:"bucket"`
+}
+
+// String never includes the password so credentials are safe to log
+func (c Credential) String() string {
+	return c.user() + ":****"
+}
+
+// GoString keeps %#v from printing the password
+func (c Credential) GoString() string {
+	return c.String()
+}
+
+func (c Credential) user() string {
+	if c.Bucket != "" {
+		return "local:" + c.Bucket
+	}
+	return c.User
+}
+
+// MarshalJSON writes the n1ql_creds form of the credential
+func (c Credential) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+	}{c.user(), c.Pass})
+}
+
+// CredentialSource reads query service credentials from, highest
+// precedence first:
+//
+//	-n1qlUser and -n1qlPass
+//	N1QL_USER and N1QL_PASS environment variables
+//	-n1qlCredsFile, a YAML or JSON list of credentials
+//	-n1qlCredsZk, a zookeeper config path holding {"Creds": [...]}
+//
+// Credentials for the same user or bucket from a lower source are replaced.
+type CredentialSource struct {
+	user   *string
+	pass   *string
+	file   *string
+	zkPath *string
+}
+
+// CredentialFlags registers the credential flags on the default flag set
+func CredentialFlags() *CredentialSource {
+	return &CredentialSource{
+		user:   flag.String("n1qlUser", "", "query service user, admin:<name> for the administrator"),
+		pass:   flag.String("n1qlPass", "", "query service password"),
+		file:   flag.String("n1qlCredsFile", "", "YAML or JSON file with a list of user/bucket and pass"),
+		zkPath: flag.String("n1qlCredsZk", "", "zookeeper config path with the query service credentials"),
+	}
+}
+
+// Load returns the merged credentials. It is not an error to have none.
+func (cs *CredentialSource) Load() ([]Credential, error) {
+	merged := make([]Credential, 0)
+	add := func(creds ...Credential) {
+	next:
+		for _, c := range creds {
+			if c.user() == "" {
+				continue
+			}
+			for i := range merged {
+				if merged[i].user() == c.user() {
+					merged[i] = c
+					continue next
+				}
+			}
+			merged = append(merged, c)
+		}
+	}
+
+	if *cs.zkPath != "" {
+		var zk struct{ Creds []Credential }
+		err := zootils.GetInstance().LoadConfig(&zk, *cs.zkPath, func(string) {})
+		if err != nil {
+			return nil, fmt.Errorf("loading credentials from %v: %v", *cs.zkPath, err)
+		}
+		add(zk.Creds...)
+	}
+
+	if *cs.file != "" {
+		creds, err := readCredentials(*cs.file)
+		if err != nil {
+			return nil, err
+		}
+		add(creds...)
+	}
+
+	add(Credential{User: os.Getenv("N1QL_USER"), Pass: os.Getenv("N1QL_PASS")})
+	add(Credential{User: *cs.user, Pass: *cs.pass})
+
+	return merged, nil
+}
+
+func readCredentials(path string) ([]Credential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file holds passwords, refuse it if others can read it
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("credentials file %v must not be accessible by group or others", path)
+	}
+
+	var creds []Credential
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &creds)
+	default:
+		err = json.Unmarshal(data, &creds)
+	}
+	if err != nil {
+		// don't include the file contents in the error
+		return nil, fmt.Errorf("credentials file %v is not a list of credentials", path)
+	}
+	return creds, nil
+}
@@ -0,0 +1,89 @@
+package n1ql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Each runs a select and calls fn for every row as it arrives. The
+// response is decoded one row at a time straight off the connection, so
+// memory doesn't grow with the size of the result. It stops at the first
+// error from fn. Rows may have been passed to fn before the query service
+// reports an error, which comes after the results.
+func (c *Client) Each(ctx context.Context, fn func(row map[string]interface{}) error, query string, args ...interface{}) error {
+	resp, err := c.post(ctx, query, args)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	if err = expectDelim(dec, '{'); err != nil {
+		return fmt.Errorf("invalid response from query service, status %v: %v", resp.Status, err)
+	}
+
+	var sr serviceResponse
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+
+		switch tok {
+		case "results":
+			if err = eachResult(dec, fn); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return err
+			}
+		case "status":
+			err = dec.Decode(&sr.Status)
+		case "errors":
+			err = dec.Decode(&sr.Errors)
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if sr.Status != "success" {
+		if len(sr.Errors) > 0 {
+			return fmt.Errorf("query %v: %v (code %v)", sr.Status, sr.Errors[0].Msg, sr.Errors[0].Code)
+		}
+		return fmt.Errorf("query %v", sr.Status)
+	}
+	return nil
+}
+
+// eachResult decodes the results array element by element
+func eachResult(dec *json.Decoder, fn func(row map[string]interface{}) error) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := fn(resultRow(raw)); err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
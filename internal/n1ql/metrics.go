@@ -0,0 +1,181 @@
+package n1ql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics are the statistics the query service returns with each request
+type Metrics struct {
+	ElapsedTime   time.Duration
+	ExecutionTime time.Duration
+	ResultCount   int64
+	ResultSize    int64
+	ErrorCount    int64
+	WarningCount  int64
+}
+
+type serviceRequest struct {
+	Statement string        `json:"statement"`
+	Args      []interface{} `json:"args,omitempty"`
+	Creds     []Credential  `json:"creds,omitempty"`
+	Timeout   string        `json:"timeout,omitempty"`
+}
+
+type serviceResponse struct {
+	Status    string            `json:"status"`
+	Signature json.RawMessage   `json:"signature"`
+	Results   []json.RawMessage `json:"results"`
+	Errors    []struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	} `json:"errors"`
+	Metrics struct {
+		ElapsedTime   string `json:"elapsedTime"`
+		ExecutionTime string `json:"executionTime"`
+		ResultCount   int64  `json:"resultCount"`
+		ResultSize    int64  `json:"resultSize"`
+		ErrorCount    int64  `json:"errorCount"`
+		WarningCount  int64  `json:"warningCount"`
+	} `json:"metrics"`
+}
+
+// QueryWithMetrics runs a select through the query service REST API, which
+// unlike the sql driver exposes the request metrics. Cancelling ctx aborts
+// the request.
+func (c *Client) QueryWithMetrics(ctx context.Context, query string, args ...interface{}) ([]string, []map[string]interface{}, Metrics, error) {
+	var metrics Metrics
+
+	resp, err := c.post(ctx, query, args)
+	if err != nil {
+		return nil, nil, metrics, err
+	}
+	defer resp.Body.Close()
+
+	var sr serviceResponse
+	if err = json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return nil, nil, metrics, fmt.Errorf("invalid response from query service, status %v: %v", resp.Status, err)
+	}
+
+	metrics.ElapsedTime, _ = time.ParseDuration(sr.Metrics.ElapsedTime)
+	metrics.ExecutionTime, _ = time.ParseDuration(sr.Metrics.ExecutionTime)
+	metrics.ResultCount = sr.Metrics.ResultCount
+	metrics.ResultSize = sr.Metrics.ResultSize
+	metrics.ErrorCount = sr.Metrics.ErrorCount
+	metrics.WarningCount = sr.Metrics.WarningCount
+
+	if sr.Status != "success" {
+		if len(sr.Errors) > 0 {
+			return nil, nil, metrics, fmt.Errorf("query %v: %v (code %v)", sr.Status, sr.Errors[0].Msg, sr.Errors[0].Code)
+		}
+		return nil, nil, metrics, fmt.Errorf("query %v", sr.Status)
+	}
+
+	rows := make([]map[string]interface{}, 0, len(sr.Results))
+	for _, raw := range sr.Results {
+		rows = append(rows, resultRow(raw))
+	}
+
+	cols := objectKeys(sr.Signature)
+	if len(cols) == 0 {
+		cols = rowKeys(rows)
+	}
+	return cols, rows, metrics, nil
+}
+
+// post sends a statement to the query service REST API. Cancelling ctx
+// aborts the request.
+func (c *Client) post(ctx context.Context, query string, args []interface{}) (*http.Response, error) {
+	body, err := json.Marshal(&serviceRequest{
+		Statement: query,
+		Args:      args,
+		Creds:     c.cfg.Creds,
+		Timeout:   timeoutString(c.cfg.Timeout),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(c.cfg.Server, "/")+"/query/service", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// resultRow decodes one element of the results array
+func resultRow(raw json.RawMessage) map[string]interface{} {
+	row, ok := decode(raw).(map[string]interface{})
+	if !ok {
+		// select raw / select value results aren't objects
+		row = map[string]interface{}{"$1": decode(raw)}
+	}
+	return row
+}
+
+func timeoutString(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// objectKeys returns the keys of a JSON object in the order they appear,
+// which for the result signature is the order of the select list. It
+// returns nil when the signature doesn't name the columns, as for select *
+// ({"*": "*"}) or select raw (a bare type).
+func objectKeys(raw json.RawMessage) []string {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+
+	keys := make([]string, 0)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if tok.(string) == "*" {
+			return nil
+		}
+		keys = append(keys, tok.(string))
+
+		var skip json.RawMessage
+		if err = dec.Decode(&skip); err != nil {
+			return nil
+		}
+	}
+	return keys
+}
+
+// rowKeys returns every key used by the rows, sorted
+func rowKeys(rows []map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, row := range rows {
+		for key := range row {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
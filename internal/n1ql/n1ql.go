@@ -0,0 +1,274 @@
+// Package n1ql is the N1QL client shared by the dash_query and del_items
+// commands. It keeps a pool of connections per query server and config, and
+// turns result rows into maps with JSON values decoded.
+package n1ql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/couchbase/go_n1ql"
+)
+
+// Config describes how to reach the query service
+type Config struct {
+	Server  string        // query service URL, e.g. http://localhost:8093
+	Timeout time.Duration // server side timeout of each request
+	Creds   []Credential
+}
+
+// Client is safe for concurrent use. database/sql keeps a pool of
+// connections to the query service behind it.
+type Client struct {
+	cfg  Config
+	db   *sql.DB
+	http *http.Client
+}
+
+var (
+	clientsMu sync.Mutex
+	clients   = make(map[string]*Client)
+)
+
+// Open returns the client for cfg, connecting on first use. Opening the
+// same server with a different timeout or credentials makes a new client.
+// The driver reads the timeout and credentials from the process environment
+// when it connects, so they are set again for every new client.
+func Open(cfg Config) (*Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	key, err := cfg.key()
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := clients[key]; ok {
+		return c, nil
+	}
+
+	if cfg.Timeout > 0 {
+		os.Setenv("n1ql_timeout", cfg.Timeout.String())
+	}
+	if len(cfg.Creds) > 0 {
+		ac, err := json.Marshal(cfg.Creds)
+		if err != nil {
+			return nil, err
+		}
+		os.Setenv("n1ql_creds", string(ac))
+	}
+
+	db, err := sql.Open("n1ql", cfg.Server)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to reach query service %v: %v", cfg.Server, err)
+	}
+
+	c := &Client{cfg: cfg, db: db, http: &http.Client{}}
+	clients[key] = c
+	return c, nil
+}
+
+// key identifies the whole config in the client cache
+func (cfg Config) key() (string, error) {
+	creds, err := json.Marshal(cfg.Creds)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s|%v|%s", cfg.Server, cfg.Timeout, creds), nil
+}
+
+type queryReply struct {
+	cols []string
+	rows []map[string]interface{}
+	err  error
+}
+
+type execReply struct {
+	n   int64
+	err error
+}
+
+// Query runs a select and returns the result columns and rows. The driver
+// doesn't support contexts, so when ctx is done Query returns ctx.Err()
+// straight away and the abandoned request is left to the server timeout.
+func (c *Client) Query(ctx context.Context, query string, args ...interface{}) ([]string, []map[string]interface{}, error) {
+	done := make(chan queryReply, 1)
+	go func() {
+		rows, err := c.db.QueryContext(ctx, query, args...)
+		if err != nil {
+			done <- queryReply{err: err}
+			return
+		}
+		defer rows.Close()
+
+		cols, results, err := ScanRows(rows)
+		done <- queryReply{cols, results, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.cols, r.rows, r.err
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// Exec runs a statement and returns the number of documents it changed.
+// Like Query it stops waiting when ctx is done.
+func (c *Client) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	done := make(chan execReply, 1)
+	go func() {
+		result, err := c.db.ExecContext(ctx, query, args...)
+		if err != nil {
+			done <- execReply{err: err}
+			return
+		}
+		n, err := result.RowsAffected()
+		done <- execReply{n, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.n, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// ScanRows reads every row into a map keyed by column name
+func ScanRows(rows *sql.Rows) ([]string, []map[string]interface{}, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vals := make([]interface{}, len(cols))
+	for i := range vals {
+		vals[i] = new(interface{})
+	}
+
+	results := make([]map[string]interface{}, 0)
+	for rows.Next() {
+		if err = rows.Scan(vals...); err != nil {
+			return nil, nil, err
+		}
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			row[col] = Value(*vals[i].(*interface{}))
+		}
+		results = append(results, row)
+	}
+
+	return cols, results, rows.Err()
+}
+
+// Value converts a scanned column into a plain Go value. The driver returns
+// everything except strings as raw JSON, which is decoded here so numbers
+// come back as int64 or float64 and objects as maps.
+func Value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return decode(v)
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999")
+	default:
+		return v
+	}
+}
+
+// decode parses raw JSON, falling back to the raw text if it isn't valid
+func decode(raw []byte) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return string(raw)
+	}
+	return numbers(v)
+}
+
+// numbers replaces json.Number with int64 where it fits and float64 otherwise
+func numbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, val := range v {
+			v[key] = numbers(val)
+		}
+		return v
+	case []interface{}:
+		for i, val := range v {
+			v[i] = numbers(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Float returns a numeric column value, parsing it if it arrived as a string
+func Float(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// String returns a column value as text, e.g. for use as a map key
+func String(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// ReadQueries reads a file of one query per line, skipping blank lines
+func ReadQueries(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	return lines, scanner.Err()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
 	"log"
@@ -10,7 +11,7 @@ import (
 
 	"github.com/couchbase/go-couchbase"
 	"github.com/moonfrog/badger/common"
-	"github.com/moonfrog/badger/zootils"
+	"github.com/moonfrog/cbutils/internal/config"
 )
 
 type RedshiftConfig struct {
@@ -59,28 +60,26 @@ order by mbytes desc, a.db_id, a.name`
 
 func main() {
 
-	var config RedshiftConfig
+	var rsConfig RedshiftConfig
+	var cbConfig CouchbaseConfig
 	var tsList = make([]*tableSize, 0)
 
+	loader := config.New()
+	loader.Add("config/redshiftProduction", &rsConfig)
+	loader.Add("config/couchbase", &cbConfig)
+	flag.Parse()
+
 	common.Init("redshift", 3000)
-	err := zootils.GetInstance().LoadConfig(&config, "config/redshiftProduction", func(string) {})
+	err := loader.Load()
 
 	if err != nil {
 		log.Fatalf("Couldn't load config. Err - %s", err)
 
 	}
 
-	if config.DbName == "" || config.DbUser == "" || config.DbHost == "" ||
-		config.DbPassword == "" || config.DbPort == "" {
-		log.Fatalf("Config error %v", config)
-	}
-
-	var cbConfig CouchbaseConfig
-	err = zootils.GetInstance().LoadConfig(&cbConfig, "config/couchbase", func(string) {})
-
-	if err != nil {
-		log.Fatalf("Couldn't load config. Err - %s", err)
-
+	if rsConfig.DbName == "" || rsConfig.DbUser == "" || rsConfig.DbHost == "" ||
+		rsConfig.DbPassword == "" || rsConfig.DbPort == "" {
+		log.Fatalf("Config error %v", rsConfig)
 	}
 
 	if cbConfig.ServerURL == "" || cbConfig.Bucket == "" {
@@ -89,11 +88,11 @@ func main() {
 
 	url := fmt.Sprintf("sslmode=require user=%v password=%v host=%v port=%v dbname=%v "+
 		"connect_timeout=0",
-		config.DbUser,
-		config.DbPassword,
-		config.DbHost,
-		config.DbPort,
-		config.DbName)
+		rsConfig.DbUser,
+		rsConfig.DbPassword,
+		rsConfig.DbHost,
+		rsConfig.DbPort,
+		rsConfig.DbName)
 
 	db, err := sql.Open("postgres", url)
 	if err != nil {